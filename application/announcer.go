@@ -10,13 +10,16 @@ import (
 type Announcer struct {
 	FederatedTopic string
 	stop           chan bool
+	done           chan bool
 }
 
 // Drop stops the Announcer
 // from sending core announcements
-// to the federated network
+// to the federated network, it returns
+// once the last announcement was queued
 func (a Announcer) Drop() {
-	a.stop <- true
+	close(a.stop)
+	<-a.done
 	fmt.Println("Stop announcing as core")
 }
 
@@ -25,32 +28,36 @@ func (a Announcer) Drop() {
 // in the federated network
 func NewAnnouncer(federatedTopic string, ctx *FederatorContext) *Announcer {
 	ann := CoreAnn{
-		CoreId:   ctx.Id,
-		Seqn:     0,
-		Dist:     0,
-		SenderId: ctx.Id,
+		Seqn: 0,
+		Dist: 0,
 	}
 
 	stop := make(chan bool)
+	done := make(chan bool)
 
 	go func() {
+		defer close(done)
+
 		for {
 			select {
 			case <-stop:
 				fmt.Println("Stop announcing as core goroutine")
 				return
-			default:
-				time.Sleep(ctx.CoreAnnInterval)
+			case <-time.After(ctx.coreAnnInterval()):
+				// read on every round so a reconfigured id or priority is announced
+				ann.CoreId = ctx.id()
+				ann.SenderId = ann.CoreId
+				ann.Priority = ctx.corePriority(federatedTopic)
 
 				// Send core announcement to all neighbors
-				for _, neighbor := range ctx.Neighbors {
+				for _, neighbor := range ctx.neighbors() {
 
 					// Serialize the core announcement
 					topic, coreAnn := ann.Serialize(federatedTopic)
 
 					// Publish the core announcement
 					fmt.Println("Sending core announcement to neighbor: ", neighbor.ClientIP, " On Topic: ", topic, " With CoreAnn: ", string(coreAnn))
-					_, err := neighbor.Publish(topic, string(coreAnn), 2, true)
+					err := neighbor.PublishAsync(topic, string(coreAnn), 2, true)
 					if err != nil {
 						fmt.Println("error while send coreAnn")
 					}
@@ -61,10 +68,11 @@ func NewAnnouncer(federatedTopic string, ctx *FederatorContext) *Announcer {
 		}
 	}()
 
-	fmt.Println(ctx.Id, "Start announcing as core")
+	fmt.Println(ctx.id(), "Start announcing as core")
 
 	return &Announcer{
 		FederatedTopic: federatedTopic,
 		stop:           stop,
+		done:           done,
 	}
 }
@@ -0,0 +1,234 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	paho "mqtt-fed/infra/queue"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MAX_BATCH_MESSAGES = 256
+
+var ErrNotRoutedPub = errors.New("only routed pubs can be batched")
+
+// Batcher is a struct that
+// coalesces the routed pubs sent to the same
+// neighbor within a window into one envelope,
+// it is shared by every worker so it is safe for
+// concurrent use, a zero window disables it
+type Batcher struct {
+	ctx     *FederatorContext
+	mu      sync.Mutex
+	window  time.Duration
+	batches map[int64]*neighborBatch
+}
+
+// neighborBatch keeps the messages waiting for a neighbor
+type neighborBatch struct {
+	Messages []BatchedMessage
+	Size     int
+	Qos      byte
+	Timer    *time.Timer
+}
+
+// NewBatcher creates a new Batcher instance
+func NewBatcher(ctx *FederatorContext, window time.Duration) *Batcher {
+	return &Batcher{
+		ctx:     ctx,
+		window:  window,
+		batches: make(map[int64]*neighborBatch),
+	}
+}
+
+// SetWindow changes the batching window, the messages
+// already waiting are sent with the previous one
+func (b *Batcher) SetWindow(window time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.window = window
+}
+
+// Enabled checks if the routed pubs are being batched
+func (b *Batcher) Enabled() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.window > 0
+}
+
+// Enqueue adds a serialized routed pub to the batch of a neighbor, the
+// batch is sent when the window ends or when the message would not fit
+func (b *Batcher) Enqueue(neighborId int64, topic string, payload []byte, qos byte) {
+	b.mu.Lock()
+
+	batch, ok := b.batches[neighborId]
+	if !ok {
+		batch = &neighborBatch{}
+		b.batches[neighborId] = batch
+	}
+
+	message := BatchedMessage{Topic: topic, Qos: qos, Payload: payload}
+	size := encodedSize(message) + 1 // the comma between the messages
+	full := len(batch.Messages) > 0 &&
+		(envelopeSize(b.ctx.id())+batch.Size+size > b.ctx.maxMessageSize() || len(batch.Messages) >= MAX_BATCH_MESSAGES)
+
+	var ready *neighborBatch
+	if full {
+		ready = b.take(neighborId)
+		batch = &neighborBatch{}
+		b.batches[neighborId] = batch
+	}
+
+	batch.Messages = append(batch.Messages, message)
+	batch.Size += size
+	if qos > batch.Qos {
+		batch.Qos = qos
+	}
+
+	if batch.Timer == nil {
+		batch.Timer = time.AfterFunc(b.window, func() {
+			b.Flush(neighborId)
+		})
+	}
+
+	b.mu.Unlock()
+
+	if ready != nil {
+		b.send(neighborId, ready)
+	}
+}
+
+// encodedSize returns the size of a message once it is in the envelope,
+// the topic and the JSON field names count as much as the payload
+func encodedSize(message BatchedMessage) int {
+	encoded, err := json.Marshal(message)
+
+	if err != nil {
+		return len(message.Topic) + len(message.Payload)
+	}
+
+	return len(encoded)
+}
+
+// envelopeSize returns the size of an envelope without messages
+func envelopeSize(senderId int64) int {
+	encoded, _ := json.Marshal(RoutedBatch{SenderId: senderId, Messages: []BatchedMessage{}})
+
+	return len(encoded)
+}
+
+// Flush sends the batch waiting for a neighbor
+func (b *Batcher) Flush(neighborId int64) {
+	b.mu.Lock()
+	batch := b.take(neighborId)
+	b.mu.Unlock()
+
+	if batch != nil {
+		b.send(neighborId, batch)
+	}
+}
+
+// take removes the batch of a neighbor, the lock must be held
+func (b *Batcher) take(neighborId int64) *neighborBatch {
+	batch, ok := b.batches[neighborId]
+	if !ok || len(batch.Messages) == 0 {
+		return nil
+	}
+
+	delete(b.batches, neighborId)
+
+	if batch.Timer != nil {
+		batch.Timer.Stop()
+	}
+
+	return batch
+}
+
+// send publishes the envelope of a batch, a batch of one
+// message is sent as is to save the envelope overhead
+func (b *Batcher) send(neighborId int64, batch *neighborBatch) {
+	client := b.ctx.neighbor(neighborId)
+	if client == nil {
+		fmt.Println("broker", neighborId, "is not a neighbor, dropping batch")
+		return
+	}
+
+	var topic string
+	var payload []byte
+
+	if len(batch.Messages) == 1 {
+		topic, payload = batch.Messages[0].Topic, batch.Messages[0].Payload
+	} else {
+		envelope := RoutedBatch{SenderId: b.ctx.id(), Messages: batch.Messages}
+		topic, payload = envelope.Serialize()
+	}
+
+	b.ctx.Metrics.Inc("batch.sent")
+	b.ctx.Metrics.Add("batch.messages", int64(len(batch.Messages)))
+
+	err := client.PublishAsync(topic, string(payload), batch.Qos, false)
+
+	if err != nil {
+		fmt.Println("error while send batch to", neighborId)
+	}
+}
+
+// sendTo sends a serialized routed pub to the neighbors,
+// through the batcher when batching is enabled
+func (t *TopicWorker) sendTo(topic string, payload []byte, qos byte, ids []int64) {
+	if !t.Ctx.Batcher.Enabled() {
+		SendTo(topic, payload, qos, ids, t.Ctx.neighbors())
+		return
+	}
+
+	for _, id := range ids {
+		if t.Ctx.neighbor(id) != nil {
+			t.Ctx.Batcher.Enqueue(id, topic, payload, qos)
+		} else {
+			fmt.Println("broker", id, "is not a neighbor")
+		}
+	}
+}
+
+// batchedMessage adapts a message of a batch to a queue Message
+type batchedMessage struct {
+	BatchedMessage
+}
+
+func (m batchedMessage) Topic() string                { return m.BatchedMessage.Topic }
+func (m batchedMessage) Payload() []byte              { return m.BatchedMessage.Payload }
+func (m batchedMessage) Qos() byte                    { return m.BatchedMessage.Qos }
+func (m batchedMessage) Retained() bool               { return false }
+func (m batchedMessage) Properties() *paho.Properties { return nil }
+
+// Unbatch opens a batch envelope, returns its messages so they are
+// deserialized and dispatched as if they were received one by one
+func (f *Federator) Unbatch(mqttMessage paho.Message) ([]paho.Message, error) {
+	var envelope RoutedBatch
+
+	if err := json.Unmarshal(mqttMessage.Payload(), &envelope); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("-> RoutedBatch from", envelope.SenderId, "with", len(envelope.Messages), "messages")
+
+	messages := make([]paho.Message, 0, len(envelope.Messages))
+
+	for _, message := range envelope.Messages {
+		if !strings.HasPrefix(message.Topic, ROUTING_TOPICS_LEVEL) {
+			return nil, ErrNotRoutedPub
+		}
+
+		messages = append(messages, batchedMessage{message})
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,107 @@
+package application
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const COMPRESSION_GZIP = "gzip"
+
+// DEFAULT_COMPRESS_MIN is used when the policy does not set a threshold,
+// smaller payloads do not pay back the compression header
+const DEFAULT_COMPRESS_MIN = 256
+
+// MAX_DECOMPRESSED_SIZE protects the federator against compression bombs
+const MAX_DECOMPRESSED_SIZE = 64 * 1024 * 1024
+
+var ErrUnknownEncoding = errors.New("unknown payload encoding")
+var ErrDecompressedTooLarge = errors.New("decompressed payload is too large")
+
+// compressMin returns the compression threshold or its default
+func (p TopicPolicy) compressMin() int {
+	if p.CompressMin <= 0 {
+		return DEFAULT_COMPRESS_MIN
+	}
+
+	return p.CompressMin
+}
+
+// compressPayload compresses a payload with the given encoding
+func compressPayload(encoding string, payload []byte) ([]byte, error) {
+	if encoding != COMPRESSION_GZIP {
+		return nil, ErrUnknownEncoding
+	}
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decompressPayload reverts compressPayload, an empty encoding
+// means the payload was sent as is
+func decompressPayload(encoding string, payload []byte) ([]byte, error) {
+	if encoding == "" {
+		return payload, nil
+	}
+
+	if encoding != COMPRESSION_GZIP {
+		return nil, ErrUnknownEncoding
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, MAX_DECOMPRESSED_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decompressed) > MAX_DECOMPRESSED_SIZE {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	return decompressed, nil
+}
+
+// compress applies the compression of the topic policy to a payload,
+// returns the payload to route and its encoding, the payload is kept
+// as is when it is below the threshold or does not get smaller
+func (t *TopicWorker) compress(topic string, payload []byte) ([]byte, string) {
+	policy := t.policy(topic)
+
+	if policy.Compression == "" || len(payload) < policy.compressMin() {
+		return payload, ""
+	}
+
+	compressed, err := compressPayload(policy.Compression, payload)
+
+	if err != nil {
+		fmt.Println("Error while compressing the payload with", policy.Compression, err)
+		return payload, ""
+	}
+
+	if len(compressed) >= len(payload) {
+		t.Ctx.Metrics.Inc("compression.skipped")
+		return payload, ""
+	}
+
+	t.Ctx.Metrics.Inc("compression.compressed")
+	t.Ctx.Metrics.Add("compression.saved_bytes", int64(len(payload)-len(compressed)))
+
+	return compressed, policy.Compression
+}
@@ -18,8 +18,9 @@ type JoinRequest struct {
 // defines the configuration of a neighbor
 // in the federated network
 type NeighborConfig struct {
-	Id int64  `json:"id"`
-	Ip string `json:"ip"`
+	Id   int64  `json:"id"`
+	Ip   string `json:"ip"`
+	Cost int    `json:"cost,omitempty"` // Cost of the link added to the core distance, one when not set
 	// SharedKey string `json:"sharedKey"`
 }
 
@@ -35,8 +36,20 @@ type FederatorConfig struct {
 	BeaconInterval  time.Duration     `json:"beaconInterval"`
 	ServerPublicKey []byte            `json:"publicKey"` // Public key of the topology manager
 	SharedKey       []byte            `json:"sharedKey"` // Shared key with the topology manager
+	ReplayWindow    time.Duration     `json:"replayWindow"`
+	Policies        Policies          `json:"policies"`
+	LinkRateLimit   RateLimit         `json:"linkRateLimit"`   // Routed publications sent per neighbor
+	MaxMessageSize  int               `json:"maxMessageSize"`  // Larger routed publications are fragmented, at least MIN_MESSAGE_SIZE
+	BatchWindow     time.Duration     `json:"batchWindow"`     // Routed publications to a neighbor are coalesced within it, zero disables it
+	CorePriority    int               `json:"corePriority"`    // Higher priority federators are elected core first
+	CoreElection    string            `json:"coreElection"`    // "priority" (default) or "lowest-id"
+	CoreTimeout     time.Duration     `json:"coreTimeout"`     // Faster core failure detection, defaults to three core ann intervals and is at least two
+	PingInterval    time.Duration     `json:"pingInterval"`    // How often the neighbor links are measured
+	MeasureLinkCost bool              `json:"measureLinkCost"` // Neighbors without a configured cost get one from their RTT and loss
+	NetworkDiameter int               `json:"networkDiameter"` // Longest shortest path in hops, the hop limit of routed pubs is derived from it
 	PrivateKey      *ecdsa.PrivateKey // My private Key
 	PublicKey       *ecdsa.PublicKey  // My public Key
+	OnUnknownNode   func()            `json:"-"` // Called when the topology manager no longer knows this federator
 }
 
 // HTTPResponse is a struct that
@@ -0,0 +1,145 @@
+package application
+
+import (
+	"time"
+
+	paho "mqtt-fed/infra/queue"
+)
+
+// The context is shared by the message handler, the workers, the
+// announcers and the link probes, and Reconfigure changes it when the
+// topology manager sends a new config. The fields that can change
+// after the start are only read and written under mu
+
+// id returns the id of this federator in the federated network
+func (ctx *FederatorContext) id() int64 {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.Id
+}
+
+// hostClient returns the client of the local broker
+func (ctx *FederatorContext) hostClient() *paho.Client {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.HostClient
+}
+
+// topologyClient returns the client of the topology manager broker
+func (ctx *FederatorContext) topologyClient() *paho.Client {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.TopologyClient
+}
+
+// neighbor returns the client of a neighbor, nil if it is not one
+func (ctx *FederatorContext) neighbor(id int64) *paho.Client {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.Neighbors[id]
+}
+
+// neighbors returns a copy of the neighbor clients,
+// safe to range over while neighbors come and go
+func (ctx *FederatorContext) neighbors() map[int64]*paho.Client {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	neighbors := make(map[int64]*paho.Client, len(ctx.Neighbors))
+	for id, client := range ctx.Neighbors {
+		neighbors[id] = client
+	}
+
+	return neighbors
+}
+
+// addNeighbor adds or replaces the client of a neighbor,
+// returns the replaced client, nil if it was not one
+func (ctx *FederatorContext) addNeighbor(id int64, client *paho.Client) *paho.Client {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	previous := ctx.Neighbors[id]
+	ctx.Neighbors[id] = client
+
+	return previous
+}
+
+// removeNeighbor removes a neighbor and returns its client, nil if it was not one
+func (ctx *FederatorContext) removeNeighbor(id int64) *paho.Client {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	client := ctx.Neighbors[id]
+	delete(ctx.Neighbors, id)
+
+	return client
+}
+
+// sharedKey returns the key shared with the topology manager
+func (ctx *FederatorContext) sharedKey() []byte {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.SharedKey
+}
+
+// election returns the policy used to compare core candidates
+func (ctx *FederatorContext) election() ElectionPolicy {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.Election
+}
+
+// policy returns the delivery policy of a federated topic
+func (ctx *FederatorContext) policy(topic string) TopicPolicy {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.Policies.Policy(topic)
+}
+
+// coreAnnInterval returns how often a core announces itself
+func (ctx *FederatorContext) coreAnnInterval() time.Duration {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.CoreAnnInterval
+}
+
+// beaconInterval returns how often local subscribers send beacons
+func (ctx *FederatorContext) beaconInterval() time.Duration {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.BeaconInterval
+}
+
+// redundancy returns how many parents a worker keeps towards the core
+func (ctx *FederatorContext) redundancy() int {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.Redundancy
+}
+
+// hopLimit returns the TTL given to the routed pubs this federator originates
+func (ctx *FederatorContext) hopLimit() int {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.InitialTTL
+}
+
+// linkRateLimit returns the limit of routed pubs sent per neighbor
+func (ctx *FederatorContext) linkRateLimit() RateLimit {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.LinkRateLimit
+}
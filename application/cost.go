@@ -0,0 +1,54 @@
+package application
+
+import "time"
+
+// DEFAULT_LINK_COST keeps the distance a hop count when no cost is configured
+const DEFAULT_LINK_COST = 1
+const MAX_LINK_COST = 1000
+
+// MEASURED_COST_UNIT is the round trip time worth one unit of
+// measured cost, coarse enough that jitter does not change the mesh
+const MEASURED_COST_UNIT = 10 * time.Millisecond
+
+// linkCosts returns the static cost of every configured neighbor
+func linkCosts(neighbors []NeighborConfig) map[int64]int {
+	costs := make(map[int64]int)
+
+	for _, neighbor := range neighbors {
+		if neighbor.Cost > 0 {
+			costs[neighbor.Id] = neighbor.Cost
+		}
+	}
+
+	return costs
+}
+
+// setLinkCost sets the configured cost of the link to a neighbor,
+// it is written by the message handler while the workers read it
+func (ctx *FederatorContext) setLinkCost(neighborId int64, cost int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.LinkCosts[neighborId] = cost
+}
+
+// linkCost returns the cost of the link to a neighbor: the configured
+// one, else the measured one if enabled, else DEFAULT_LINK_COST
+func (ctx *FederatorContext) linkCost(neighborId int64) int {
+	ctx.mu.RLock()
+	cost, configured := ctx.LinkCosts[neighborId]
+	measure := ctx.MeasureLinkCost
+	ctx.mu.RUnlock()
+
+	if configured {
+		return cost
+	}
+
+	if measure {
+		if cost, ok := ctx.Links.measuredCost(neighborId); ok {
+			return cost
+		}
+	}
+
+	return DEFAULT_LINK_COST
+}
@@ -0,0 +1,78 @@
+package application
+
+import "fmt"
+
+const ELECTION_PRIORITY = "priority"
+const ELECTION_LOWEST_ID = "lowest-id"
+
+// Candidate is a struct that
+// defines a federator competing
+// to be the core of a topic
+type Candidate struct {
+	Id       int64
+	Priority int
+}
+
+// ElectionPolicy is an interface that
+// decides which of two candidates should
+// be the core, every federator must use
+// the same policy or the mesh will not converge
+type ElectionPolicy interface {
+	Better(candidate Candidate, current Candidate) bool
+}
+
+// PriorityElection elects the candidate with the
+// highest priority, ties are broken by the lowest id
+type PriorityElection struct{}
+
+func (PriorityElection) Better(candidate Candidate, current Candidate) bool {
+	if candidate.Priority != current.Priority {
+		return candidate.Priority > current.Priority
+	}
+
+	return candidate.Id < current.Id
+}
+
+// LowestIdElection elects the candidate with the lowest id,
+// the priorities are ignored
+type LowestIdElection struct{}
+
+func (LowestIdElection) Better(candidate Candidate, current Candidate) bool {
+	return candidate.Id < current.Id
+}
+
+// NewElectionPolicy returns the election policy of the given name,
+// the priority election is the default
+func NewElectionPolicy(name string) ElectionPolicy {
+	switch name {
+	case ELECTION_LOWEST_ID:
+		return LowestIdElection{}
+	case "", ELECTION_PRIORITY:
+		return PriorityElection{}
+	default:
+		fmt.Println("Unknown core election policy", name, ", using", ELECTION_PRIORITY)
+		return PriorityElection{}
+	}
+}
+
+// corePriority returns the priority of this federator to be the
+// core of a topic, the topic policy overrides the federator one
+func (ctx *FederatorContext) corePriority(topic string) int {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if priority := ctx.Policies.Policy(topic).CorePriority; priority != nil {
+		return *priority
+	}
+
+	return ctx.CorePriority
+}
+
+// currentCandidate returns the current core of the worker as a candidate
+func (t TopicWorker) currentCandidate(core interface{}) Candidate {
+	if c, ok := core.(CoreBroker); ok {
+		return Candidate{Id: c.Id, Priority: c.Priority}
+	}
+
+	return Candidate{Id: t.Ctx.id(), Priority: t.Ctx.corePriority(t.Topic)}
+}
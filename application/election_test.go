@@ -0,0 +1,63 @@
+package application
+
+import "testing"
+
+func TestElectionBetter(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    ElectionPolicy
+		candidate Candidate
+		current   Candidate
+		want      bool
+	}{
+		{"higher priority", PriorityElection{}, Candidate{Id: 5, Priority: 2}, Candidate{Id: 1, Priority: 1}, true},
+		{"lower priority", PriorityElection{}, Candidate{Id: 1, Priority: 1}, Candidate{Id: 5, Priority: 2}, false},
+		{"tie, lower id", PriorityElection{}, Candidate{Id: 1, Priority: 1}, Candidate{Id: 5, Priority: 1}, true},
+		{"tie, higher id", PriorityElection{}, Candidate{Id: 5, Priority: 1}, Candidate{Id: 1, Priority: 1}, false},
+		{"same candidate", PriorityElection{}, Candidate{Id: 1, Priority: 1}, Candidate{Id: 1, Priority: 1}, false},
+		{"negative priority", PriorityElection{}, Candidate{Id: 1, Priority: -1}, Candidate{Id: 5, Priority: 0}, false},
+		{"lowest id", LowestIdElection{}, Candidate{Id: 1, Priority: 0}, Candidate{Id: 5, Priority: 9}, true},
+		{"lowest id ignores priority", LowestIdElection{}, Candidate{Id: 5, Priority: 9}, Candidate{Id: 1, Priority: 0}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.Better(test.candidate, test.current); got != test.want {
+			t.Errorf("%s: Better = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewElectionPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		want ElectionPolicy
+	}{
+		{"", PriorityElection{}},
+		{ELECTION_PRIORITY, PriorityElection{}},
+		{ELECTION_LOWEST_ID, LowestIdElection{}},
+		{"unknown", PriorityElection{}},
+	}
+
+	for _, test := range tests {
+		if got := NewElectionPolicy(test.name); got != test.want {
+			t.Errorf("NewElectionPolicy(%q) = %T, want %T", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCorePriority(t *testing.T) {
+	high := 7
+
+	ctx := &FederatorContext{
+		CorePriority: 3,
+		Policies:     Policies{"sensors/#": {CorePriority: &high}},
+	}
+
+	if priority := ctx.corePriority("sensors/temp"); priority != 7 {
+		t.Errorf("topic priority %d, want 7", priority)
+	}
+
+	if priority := ctx.corePriority("actuators/fan"); priority != 3 {
+		t.Errorf("federator priority %d, want 3", priority)
+	}
+}
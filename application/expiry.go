@@ -0,0 +1,36 @@
+package application
+
+import (
+	"time"
+
+	paho "mqtt-fed/infra/queue"
+)
+
+// remainingExpiry returns the properties of a pub delivered to the local
+// subscribers with the MQTT 5 message expiry reduced by the time since the
+// origin published it, false when the pub expired on its way. Pubs from
+// federators that predate the origin time keep the expiry they carry
+func remainingExpiry(props *paho.Properties, published int64) (*paho.Properties, bool) {
+	if props == nil || props.MessageExpiry == nil || published == 0 {
+		return props, true
+	}
+
+	// a clock behind the origin one must not extend the expiry
+	elapsed := time.Since(time.Unix(0, published))
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	expiry := time.Duration(*props.MessageExpiry) * time.Second
+	if elapsed >= expiry {
+		return nil, false
+	}
+
+	// rounded up, a pub with a few milliseconds left is still delivered
+	remaining := uint32((expiry - elapsed + time.Second - 1) / time.Second)
+
+	reduced := *props
+	reduced.MessageExpiry = &remaining
+
+	return &reduced, true
+}
@@ -0,0 +1,149 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+// coreTimeout returns how long a core can be silent before it is
+// considered dead, three core ann intervals unless configured
+func (ctx *FederatorContext) coreTimeout() time.Duration {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if ctx.CoreTimeout <= 0 {
+		return 3 * ctx.CoreAnnInterval
+	}
+
+	return ctx.CoreTimeout
+}
+
+// MIN_CORE_TIMEOUT_INTERVALS is the shortest core timeout in core ann
+// intervals, one late ann must not be taken for a dead core
+const MIN_CORE_TIMEOUT_INTERVALS = 2
+
+// checkCoreTimeout raises a configured core timeout that would expire
+// a live core between two of its anns and make the cores flap
+func checkCoreTimeout(timeout time.Duration, coreAnnInterval time.Duration) time.Duration {
+	minimum := MIN_CORE_TIMEOUT_INTERVALS * coreAnnInterval
+
+	if timeout > 0 && timeout < minimum {
+		fmt.Println("Core timeout", timeout, "is too short for a core ann interval of", coreAnnInterval, ", using", minimum)
+		return minimum
+	}
+
+	return timeout
+}
+
+// handleLinkLost drops a neighbor whose connection was lost from the
+// mesh, when it was the last parent towards the core the core is
+// considered lost right away and a new one is elected
+func (t *TopicWorker) handleLinkLost(neighborId int64) {
+	delete(t.Children, neighborId)
+
+	core, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(CoreBroker)
+	if !ok {
+		return
+	}
+
+	var candidates []int64
+	for _, candidate := range core.Candidates {
+		if candidate != neighborId {
+			candidates = append(candidates, candidate)
+		}
+	}
+	t.CurrentCore.Other.Candidates = candidates
+
+	var parents []Parent
+	for _, parent := range core.Parents {
+		if parent.Id != neighborId {
+			parents = append(parents, parent)
+		}
+	}
+
+	if len(parents) == len(core.Parents) {
+		return
+	}
+
+	t.CurrentCore.Other.Parents = parents
+
+	if len(parents) > 0 && core.Id != neighborId {
+		fmt.Println("Lost parent", neighborId, "of", t.Topic, ",", len(parents), "parents left")
+		return
+	}
+
+	fmt.Println("Lost the link towards core", core.Id, "of", t.Topic)
+	t.failover()
+}
+
+// handleCoreTick checks if the core is still alive, a core that
+// stopped announcing is replaced without waiting for the next beacon
+func (t *TopicWorker) handleCoreTick() {
+	t.CoreTimer = nil
+
+	// announcing itself or without core, there is nobody to time out
+	if t.CurrentCore.Other.LastHeard.IsZero() {
+		return
+	}
+
+	if _, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(CoreBroker); ok {
+		t.scheduleCoreCheck()
+		return
+	}
+
+	fmt.Println("Core", t.CurrentCore.Other.Id, "of", t.Topic, "timed out")
+	t.failover()
+}
+
+// failover forgets the current core and, if there are local
+// subscribers, starts announcing itself so the election starts now
+func (t *TopicWorker) failover() {
+	t.CurrentCore = Core{}
+	t.Children = make(map[int64]time.Time)
+	t.FailoverStarted = time.Now()
+
+	t.Ctx.Metrics.Inc("core.failovers")
+
+	if t.hasLocalSub() {
+		t.handleBeacon()
+	}
+}
+
+// coreElected is called when a core ann from another core is accepted, it
+// ends a failover and keeps in the metrics the time the topic had no core to follow
+func (t *TopicWorker) coreElected() {
+	t.scheduleCoreCheck()
+
+	if t.FailoverStarted.IsZero() {
+		return
+	}
+
+	elapsed := time.Since(t.FailoverStarted)
+	t.FailoverStarted = time.Time{}
+
+	fmt.Println("New core of", t.Topic, "after", elapsed)
+	t.Ctx.Metrics.Observe("core.failover_time", elapsed)
+}
+
+// selfElected is called when this federator starts announcing itself as the
+// core, it ends a failover too, without a time for the metrics: another
+// core elected later would otherwise be kept as a very long failover
+func (t *TopicWorker) selfElected() {
+	t.FailoverStarted = time.Time{}
+}
+
+// scheduleCoreCheck makes sure a core tick comes through the
+// worker channel when the current core would time out
+func (t *TopicWorker) scheduleCoreCheck() {
+	if t.CoreTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+	expiry := time.Until(t.CurrentCore.Other.LastHeard.Add(t.Ctx.coreTimeout()))
+
+	t.CoreTimer = time.AfterFunc(expiry, func() {
+		channel <- Message{Type: "CoreTick", Topic: topic}
+	})
+}
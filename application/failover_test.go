@@ -0,0 +1,48 @@
+package application
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckCoreTimeout(t *testing.T) {
+	interval := 5 * time.Second
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"default", 0, 0},
+		{"long enough", 15 * time.Second, 15 * time.Second},
+		{"exactly two intervals", 10 * time.Second, 10 * time.Second},
+		{"shorter than an interval", time.Second, 10 * time.Second},
+		{"between one and two intervals", 7 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkCoreTimeout(test.timeout, interval); got != test.want {
+				t.Fatalf("checkCoreTimeout(%v) = %v, want %v", test.timeout, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelfElectionEndsFailover(t *testing.T) {
+	worker := newTestWorker("sensors/temp")
+	worker.Ctx.CoreAnnInterval = time.Second
+	worker.Ctx.BeaconInterval = time.Second
+
+	worker.FailoverStarted = time.Now().Add(-time.Hour)
+
+	worker.handleBeacon()
+
+	if !worker.FailoverStarted.IsZero() {
+		t.Fatal("failover still running after this federator started announcing itself")
+	}
+
+	if worker.Ctx.Metrics.Snapshot().Durations["core.failover_time"].Count != 0 {
+		t.Fatal("self election kept as a failover time")
+	}
+}
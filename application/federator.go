@@ -2,15 +2,18 @@ package application
 
 import (
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	paho "mqtt-fed/infra/queue"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	keys "mqtt-fed/infra/crypto"
+	"mqtt-fed/infra/metrics"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 // FederatorContext is a struct that
@@ -28,6 +31,26 @@ type FederatorContext struct {
 	PrivateKey      *ecdsa.PrivateKey // my private key (can be stored as ecdsa.PrivateKey cuz will not be shared)
 	PublicKey       []byte            // my public key
 	SharedKey       []byte            // shared key with the topology manager
+	Delivered       *lru.Cache        // publications already sent to local subscribers, shared by all workers
+	MQTTVersion     int               // MQTT version of the host and neighbor links
+	Policies        Policies          // per topic delivery options
+	Metrics         *metrics.Registry
+	ReplayWindow    time.Duration // how old a secure publication can be when delivered
+	Limiter         *RateLimiter  // token buckets of the rate limited topics, origins and links
+	LinkRateLimit   RateLimit     // routed publications sent per neighbor
+	MaxMessageSize  int           // largest message sent to a neighbor, larger routed publications are fragmented
+	Batcher         *Batcher      // coalesces the routed publications sent to each neighbor
+	CorePriority    int           // priority of this federator in the core elections
+	Election        ElectionPolicy
+	CoreTimeout     time.Duration  // how long a silent core is kept, defaults to three core ann intervals
+	OnLinkLost      func(id int64) // called when the connection to a neighbor is lost
+	Links           *LinkMonitor   // RTT and loss of the neighbor links
+	PingInterval    time.Duration
+	LinkCosts       map[int64]int // configured cost of the neighbor links
+	MeasureLinkCost bool          // neighbors without a configured cost get one from their link quality
+	InitialTTL      int           // hop limit of the routed publications
+	Epoch           int64         // start time of this federator, set once, given to the pub ids it originates
+	mu              sync.RWMutex  // guards the fields Reconfigure changes, see context.go
 }
 
 // Federator is a struct that
@@ -37,94 +60,395 @@ type FederatorContext struct {
 // from the federated network and dispatching
 // them to the appropriate workers
 type Federator struct {
-	Ctx     *FederatorContext
-	Workers map[string]*TopicWorkerHandle
+	Ctx           *FederatorContext
+	Workers       map[string]*TopicWorkerHandle
+	Seqns         map[string]int // next publication sequence of each concrete topic
+	OnUnknownNode func()         // called when the topology manager no longer knows this federator
+	workersMu     sync.Mutex     // the workers are also reached from the link goroutines
+	seqnsMu       sync.Mutex     // delayed federated pubs take their sequence from a timer goroutine
+	handler       paho.MessageHandler
 }
 
 // Run starts the federator
 // and consumes messages from the
 // federated network
 func (f *Federator) Run() {
-	topics := map[string]byte{
-		TOPOLOGY_ANN_LEVEL:      2,
-		CORE_ANNS:               2,
-		MEMB_ANNS:               2,
-		MEMB_ACK:                2,
-		ROUTING_TOPICS:          2,
-		SECURE_ROUTING_TOPICS:   2,
-		FEDERATED_TOPICS:        2,
-		SECURE_FEDERATED_TOPICS: 2,
-		BEACONS:                 2,
-		SECURE_BEACONS:          2,
-		NODE_ANN_LEVEL + strconv.FormatInt(f.Ctx.Id, 10): 2,
-	}
-
 	// Message handler for consuming messages
-	messageHandler := func(client mqtt.Client, mqttMsg mqtt.Message) {
+	var messageHandler paho.MessageHandler
+	messageHandler = func(mqttMsg paho.Message) {
+		// a batch envelope is opened and each of its routed pubs handled on its own
+		if mqttMsg.Topic() == BATCH_TOPIC {
+			messages, err := f.Unbatch(mqttMsg)
+
+			if err != nil {
+				fmt.Println("error on handle batch: ", err)
+				return
+			}
+
+			for _, message := range messages {
+				messageHandler(message)
+			}
+
+			return
+		}
+
 		// Deserialize the message
 		msg, err := f.Deserialize(mqttMsg)
 
-		// Get the federated topic
-		federatedTopic := msg.Topic
+		// the withdrawal sent along with the clear is what replaces the core
+		if errors.Is(err, ErrCoreAnnCleared) {
+			fmt.Println("Retained core ann cleared on", mqttMsg.Topic())
+			return
+		}
 
 		if err == nil {
+			// Get the federated topic
+			federatedTopic := msg.Topic
+
 			// Check if the message is a topology announcement
 			// and add or remove the neighbor from the neighbors
-			if msg.Type == "TopologyAnn" {
+			if msg.Type == "NodeAnn" && msg.NodeAnn.Action == "UNKNOWN_NODE" {
+				fmt.Println("Topology manager does not know this federator")
+
+				if f.OnUnknownNode != nil {
+					f.OnUnknownNode()
+				}
+			} else if msg.Type == "Ping" {
+				f.handlePing(msg.Ping)
+			} else if msg.Type == "Pong" {
+				f.handlePong(msg.Pong)
+			} else if msg.Type == "TopologyAnn" {
 				fmt.Println("Topology ann received: ", msg.TopologyAnn.Neighbor.Id, " Action: ", msg.TopologyAnn.Action)
 
 				if msg.TopologyAnn.Action == "NEW" {
-					mqttClient, err := paho.NewClient(msg.TopologyAnn.Neighbor.Ip, f.Ctx.HostClient.ClientID)
+					mqttClient, err := paho.NewClientVersion(msg.TopologyAnn.Neighbor.Ip, clientID(f.Ctx.id()), f.Ctx.MQTTVersion)
 
 					if err == nil {
-						f.Ctx.Neighbors[msg.TopologyAnn.Neighbor.Id] = mqttClient
+						if msg.TopologyAnn.Neighbor.Cost > 0 {
+							f.Ctx.setLinkCost(msg.TopologyAnn.Neighbor.Id, msg.TopologyAnn.Neighbor.Cost)
+						}
+
+						f.Ctx.startLink(msg.TopologyAnn.Neighbor.Id, mqttClient)
+
+						// a neighbor announced again gets a new client, the old
+						// one is closed along with its outbox goroutine
+						if previous := f.Ctx.addNeighbor(msg.TopologyAnn.Neighbor.Id, mqttClient); previous != nil {
+							previous.Disconnect()
+						}
 					} else {
 						fmt.Println("Erro on adding neighbor:", err)
 					}
 
 				} else if msg.TopologyAnn.Action == "REMOVE" {
-					delete(f.Ctx.Neighbors, msg.TopologyAnn.Neighbor.Id)
+					if client := f.Ctx.removeNeighbor(msg.TopologyAnn.Neighbor.Id); client != nil {
+						client.Disconnect()
+					}
 				}
 			} else {
-				// Dispatch the message to the appropriate worker
-				if worker, ok := f.Workers[federatedTopic]; ok {
-					worker.Dispatch(*msg)
-				} else {
-					// Create a new worker for the federated topic
-					worker := NewTopicWorkerHandle(federatedTopic, f.Ctx)
-					worker.Dispatch(*msg)
-					f.Workers[federatedTopic] = worker
+				if msg.Type == "FederatedPub" {
+					f.throttleFederated(*msg)
+					return
 				}
+
+				// Dispatch the message to the appropriate worker
+				f.worker(federatedTopic).Dispatch(*msg)
 			}
 		} else {
 			fmt.Println("error on handle message: ", err)
 		}
 	}
 
-	fmt.Println("Federator", f.Ctx.Id, "started!")
+	f.handler = messageHandler
+
+	go f.probeLinks()
+
+	fmt.Println("Federator", f.Ctx.id(), "started!")
 
 	// Consume messages from the federated network
-	_, err := f.Ctx.HostClient.Consume(topics, messageHandler)
+	if err := f.consume(f.Ctx.hostClient()); err != nil {
+		panic(err)
+	}
+}
+
+// federate gives an admitted federated pub its id and dispatches it. The id
+// is assigned here, not in the worker, so the exact topic mesh and every
+// matching filter mesh share it. A delayed pub is federated from a timer
+// goroutine, so the sequences are taken under a lock
+func (f *Federator) federate(msg Message) {
+	f.seqnsMu.Lock()
+	msg.FederatedPub.PubId = PubId{
+		OriginId: f.Ctx.id(),
+		Epoch:    f.Ctx.Epoch,
+		Seqn:     f.Seqns[msg.Topic],
+	}
+	f.Seqns[msg.Topic] += 1
+	f.seqnsMu.Unlock()
+
+	msg.FederatedPub.Topic = msg.Topic
+
+	f.dispatchToFilters(msg)
+
+	// Dispatch the message to the appropriate worker
+	f.worker(msg.Topic).Dispatch(msg)
+}
+
+// topics returns the topics the federator consumes from its host broker
+func (f *Federator) topics() map[string]byte {
+	return map[string]byte{
+		TOPOLOGY_ANN_LEVEL:    2,
+		CORE_ANNS:             2,
+		MEMB_ANNS:             2,
+		MEMB_ACK:              2,
+		ROUTING_TOPICS:        2,
+		ROUTING_ACKS:          2,
+		BATCH_TOPIC:           2,
+		PING_TOPIC:            0,
+		TRACE_REQUESTS:        1,
+		TRACES:                1,
+		TRACE_REPLIES:         1,
+		PONG_TOPIC:            0,
+		NACKS:                 2,
+		CORE_WITHDRAWALS:      2,
+		MEMB_LEAVES:           2,
+		SECURE_ROUTING_TOPICS: 2,
+		BEACONS:               2,
+		SECURE_BEACONS:        2,
+		NODE_ANN_LEVEL + strconv.FormatInt(f.Ctx.id(), 10): 2,
+	}
+}
+
+// consume subscribes the host client to the federation topics and to the
+// topics local clients publish on. The retained messages replayed at
+// subscribe time are not taken from the latter, they were federated when
+// published and would be federated again on every start as new pubs
+func (f *Federator) consume(hostClient *paho.Client) error {
+	if _, err := hostClient.Consume(f.topics(), f.handler); err != nil {
+		return err
+	}
+
+	published := map[string]byte{
+		FEDERATED_TOPICS:        2,
+		SECURE_FEDERATED_TOPICS: 2,
+	}
+
+	_, err := hostClient.ConsumeLive(published, f.handler)
+
+	return err
+}
+
+// dispatchToFilters sends a federated publication to the workers
+// of every filter (beaconed with + or #) that matches its topic
+func (f *Federator) dispatchToFilters(msg Message) {
+	var matching []*TopicWorkerHandle
+
+	f.workersMu.Lock()
+	for filter, worker := range f.Workers {
+		if filter != msg.Topic && IsFilter(filter) && MatchFilter(filter, msg.Topic) {
+			fmt.Println("Federated pub on", msg.Topic, "matches filter", filter)
+			matching = append(matching, worker)
+		}
+	}
+	f.workersMu.Unlock()
+
+	for _, worker := range matching {
+		worker.Dispatch(msg)
+	}
+}
+
+// worker returns the worker of a federated topic,
+// it is created on the first message of the topic
+func (f *Federator) worker(federatedTopic string) *TopicWorkerHandle {
+	f.workersMu.Lock()
+	defer f.workersMu.Unlock()
+
+	worker, ok := f.Workers[federatedTopic]
+	if !ok {
+		// Create a new worker for the federated topic
+		worker = NewTopicWorkerHandle(federatedTopic, f.Ctx)
+		f.Workers[federatedTopic] = worker
+	}
+
+	return worker
+}
+
+// linkLost tells every worker that the connection to a neighbor
+// was lost, so a core behind it is replaced without waiting for it to expire
+func (f *Federator) linkLost(neighborId int64) {
+	fmt.Println("Link to neighbor", neighborId, "lost")
+	f.Ctx.Metrics.Inc("link." + strconv.FormatInt(neighborId, 10) + ".lost")
+
+	var workers []*TopicWorkerHandle
+
+	f.workersMu.Lock()
+	for _, worker := range f.Workers {
+		workers = append(workers, worker)
+	}
+	f.workersMu.Unlock()
+
+	for _, worker := range workers {
+		worker.Dispatch(Message{Type: "LinkLost", Topic: worker.FederatedTopic, LinkLost: neighborId})
+	}
+}
+
+// Reconfigure applies a config received after joining again,
+// neighbors that are gone are disconnected and new ones connected.
+// It runs on the bootstrap goroutine, so the context is only
+// changed under its lock
+func (f *Federator) Reconfigure(federatorConfig FederatorConfig) {
+	fmt.Println("Reconfiguring federator", f.Ctx.id())
+
+	policies := loadPolicies(federatorConfig.Policies)
+	election := NewElectionPolicy(federatorConfig.CoreElection)
+
+	maxMessageSize := federatorConfig.MaxMessageSize
+	if err := checkMaxMessageSize(maxMessageSize); err != nil {
+		fmt.Println("Keeping the max message size of", f.Ctx.maxMessageSize(), ":", err)
+		maxMessageSize = f.Ctx.maxMessageSize()
+	}
+
+	f.Ctx.mu.Lock()
+	previousId := f.Ctx.Id
+	f.Ctx.Id = federatorConfig.Id
+	f.Ctx.CoreAnnInterval = federatorConfig.CoreAnnInterval
+	f.Ctx.BeaconInterval = federatorConfig.BeaconInterval
+	f.Ctx.Redundancy = federatorConfig.Redundancy
+	f.Ctx.SharedKey = federatorConfig.SharedKey
+	f.Ctx.Policies = policies
+	f.Ctx.LinkRateLimit = federatorConfig.LinkRateLimit
+	f.Ctx.MaxMessageSize = maxMessageSize
+	f.Ctx.CorePriority = federatorConfig.CorePriority
+	f.Ctx.CoreTimeout = checkCoreTimeout(federatorConfig.CoreTimeout, federatorConfig.CoreAnnInterval)
+	f.Ctx.PingInterval = federatorConfig.PingInterval
+	f.Ctx.LinkCosts = linkCosts(federatorConfig.Neighbors)
+	f.Ctx.MeasureLinkCost = federatorConfig.MeasureLinkCost
+	f.Ctx.InitialTTL = initialTTL(federatorConfig.NetworkDiameter)
+	f.Ctx.Election = election
+	f.Ctx.mu.Unlock()
+
+	f.Ctx.Batcher.SetWindow(federatorConfig.BatchWindow)
+
+	wanted := make(map[int64]bool)
+
+	for _, neighbor := range federatorConfig.Neighbors {
+		wanted[neighbor.Id] = true
+
+		if f.Ctx.neighbor(neighbor.Id) != nil {
+			continue
+		}
+
+		mqttClient, err := paho.NewClientVersion(neighbor.Ip, clientID(federatorConfig.Id), f.Ctx.MQTTVersion)
+
+		if err == nil {
+			f.Ctx.startLink(neighbor.Id, mqttClient)
+			if previous := f.Ctx.addNeighbor(neighbor.Id, mqttClient); previous != nil {
+				previous.Disconnect()
+			}
+		} else {
+			fmt.Println("Erro on adding neighbor:", err)
+		}
+	}
+
+	for id := range f.Ctx.neighbors() {
+		if !wanted[id] {
+			// a topology ann may have removed it in the meantime
+			if client := f.Ctx.removeNeighbor(id); client != nil {
+				client.Disconnect()
+			}
+		}
+	}
+
+	if federatorConfig.Id != previousId {
+		fmt.Println("Federator id changed from", previousId, "to", federatorConfig.Id)
+		f.reconnect()
+	}
+}
+
+// reconnect connects every client again with the client id of the new
+// federator id, another federator may be given the old one. The new host
+// client subscribes to the node anns of the new id, the old subscription
+// goes away with the old client
+func (f *Federator) reconnect() {
+	clientId := clientID(f.Ctx.id())
+
+	hostClient, err := paho.NewClientVersion(hostBroker(), clientId, f.Ctx.MQTTVersion)
 
 	if err != nil {
-		panic(err)
+		fmt.Println("Error on reconnecting to the host broker:", err)
+		return
+	}
+
+	topologyClient, err := paho.NewClient(TOPOLOGY_BROKER, clientId)
+
+	if err != nil {
+		fmt.Println("Error on reconnecting to the topology manager:", err)
+		hostClient.Disconnect()
+		return
+	}
+
+	f.Ctx.mu.Lock()
+	previousHost := f.Ctx.HostClient
+	previousTopology := f.Ctx.TopologyClient
+	f.Ctx.HostClient = hostClient
+	f.Ctx.TopologyClient = topologyClient
+	f.Ctx.mu.Unlock()
+
+	// the old client is gone before the new one subscribes,
+	// so no federated pub is taken from the host broker twice
+	previousHost.Disconnect()
+	previousTopology.Disconnect()
+
+	if err := f.consume(hostClient); err != nil {
+		fmt.Println("Error subscribing with the new host client:", err)
+	}
+
+	for id, client := range f.Ctx.neighbors() {
+		if client.ClientID == clientId {
+			continue
+		}
+
+		mqttClient, err := paho.NewClientVersion(client.ClientIP, clientId, f.Ctx.MQTTVersion)
+
+		if err != nil {
+			fmt.Println("Error on reconnecting to neighbor", id, ":", err)
+			continue
+		}
+
+		f.Ctx.startLink(id, mqttClient)
+
+		if previous := f.Ctx.addNeighbor(id, mqttClient); previous != nil {
+			previous.Disconnect()
+		}
 	}
 }
 
 // Run starts the federator
 // and consumes messages from the
 // federated network
-func Run(federatorConfig FederatorConfig) {
+func Run(federatorConfig FederatorConfig) *Federator {
+	if err := checkMaxMessageSize(federatorConfig.MaxMessageSize); err != nil {
+		panic(err)
+	}
+
 	// Create a client id
-	clientId := "federator_" + strconv.FormatInt(federatorConfig.Id, 10)
+	clientId := clientID(federatorConfig.Id)
+
+	// MQTT_VERSION=5 keeps publish properties (user properties, expiry...) end to end,
+	// the topology client stays on MQTT 3 because the topology manager broker may not support 5
+	mqttVersion := paho.MQTT_V3
+	if os.Getenv("MQTT_VERSION") == "5" {
+		mqttVersion = paho.MQTT_V5
+	}
 
 	// Create neighbors clients (Usually starts empty and is updated by topology announcements)
-	neighborsClients := createNeighborsClients(federatorConfig.Neighbors, clientId)
+	neighborsClients := createNeighborsClients(federatorConfig.Neighbors, clientId, mqttVersion)
 	// Create host client
-	hostClient := createHostClient(clientId)
+	hostClient := createHostClient(clientId, mqttVersion)
 	// Create topology client
 	topologyClient := createTopologyClient(clientId)
 
+	// A publication can arrive over the exact topic mesh and over filter meshes
+	delivered, _ := lru.New(1000)
+
 	// Create federator context
 	ctx := FederatorContext{
 		Id:              federatorConfig.Id,
@@ -138,24 +462,55 @@ func Run(federatorConfig FederatorConfig) {
 		PrivateKey:      federatorConfig.PrivateKey,
 		PublicKey:       keys.ConvertECDSAPublicKeyToBytes(federatorConfig.PublicKey),
 		SharedKey:       federatorConfig.SharedKey,
+		Delivered:       delivered,
+		MQTTVersion:     mqttVersion,
+		Policies:        loadPolicies(federatorConfig.Policies),
+		Metrics:         metrics.NewRegistry(),
+		ReplayWindow:    federatorConfig.ReplayWindow,
+		Limiter:         NewRateLimiter(),
+		LinkRateLimit:   federatorConfig.LinkRateLimit,
+		MaxMessageSize:  federatorConfig.MaxMessageSize,
+		CorePriority:    federatorConfig.CorePriority,
+		CoreTimeout:     checkCoreTimeout(federatorConfig.CoreTimeout, federatorConfig.CoreAnnInterval),
+		Links:           NewLinkMonitor(),
+		PingInterval:    federatorConfig.PingInterval,
+		LinkCosts:       linkCosts(federatorConfig.Neighbors),
+		MeasureLinkCost: federatorConfig.MeasureLinkCost,
+		InitialTTL:      initialTTL(federatorConfig.NetworkDiameter),
+		Election:        NewElectionPolicy(federatorConfig.CoreElection),
+		Epoch:           time.Now().UnixNano(),
+	}
+
+	ctx.Batcher = NewBatcher(&ctx, federatorConfig.BatchWindow)
+
+	for id, client := range neighborsClients {
+		ctx.startLink(id, client)
 	}
 
 	// Create federator instance and then run it
 	federator := Federator{
 		Ctx:     &ctx,
 		Workers: make(map[string]*TopicWorkerHandle),
+		Seqns:   make(map[string]int),
+
+		// set before the handlers run, they read it without a lock
+		OnUnknownNode: federatorConfig.OnUnknownNode,
 	}
 
+	ctx.OnLinkLost = federator.linkLost
+
 	federator.Run()
+
+	return &federator
 }
 
 // createNeighborsClients creates a map of neighbors clients
 // from the neighbors configuration
-func createNeighborsClients(neighbors []NeighborConfig, clientId string) map[int64]*paho.Client {
+func createNeighborsClients(neighbors []NeighborConfig, clientId string, version int) map[int64]*paho.Client {
 	neighborsClients := make(map[int64]*paho.Client)
 
 	for _, neighbor := range neighbors {
-		mqttClient, err := paho.NewClient(neighbor.Ip, clientId)
+		mqttClient, err := paho.NewClientVersion(neighbor.Ip, clientId, version)
 
 		if err == nil {
 			neighborsClients[neighbor.Id] = mqttClient
@@ -168,17 +523,62 @@ func createNeighborsClients(neighbors []NeighborConfig, clientId string) map[int
 	return neighborsClients
 }
 
-// createHostClient creates a host client for the federator
-// it connects to the local mosquitto broker
-func createHostClient(clientId string) *paho.Client {
-	fmt.Println("Creating host client as ", clientId)
+// startLink starts the outbox of a neighbor client so the workers do not wait
+// for the link, the link rate limit is applied in it and the publish latency
+// and failures are kept in the metrics
+func (ctx *FederatorContext) startLink(id int64, client *paho.Client) {
+	name := "link." + strconv.FormatInt(id, 10)
+	registry := ctx.Metrics
+
+	client.OnConnectionLost(func(err error) {
+		if ctx.OnLinkLost != nil {
+			ctx.OnLinkLost(id)
+		}
+	})
+
+	client.StartOutbox(ctx.linkGate(id), func(latency time.Duration, err error) {
+		if err != nil {
+			registry.Inc(name + ".failed")
+			return
+		}
+
+		registry.Observe(name+".latency", latency)
+	})
+}
+
+// LinkStats returns the outbox statistics of every neighbor link
+func (f *Federator) LinkStats() map[int64]paho.LinkStats {
+	stats := make(map[int64]paho.LinkStats)
+
+	for id, client := range f.Ctx.neighbors() {
+		stats[id] = client.Stats()
+	}
+
+	return stats
+}
+
+// clientID returns the MQTT client id of a federator
+func clientID(id int64) string {
+	return "federator_" + strconv.FormatInt(id, 10)
+}
+
+// hostBroker returns the address of the local mosquitto broker
+func hostBroker() string {
 	mosquittoPort := os.Getenv("MOSQUITTO_PORT")
 
 	if mosquittoPort == "" {
 		mosquittoPort = "1883"
 	}
 
-	mqttClient, err := paho.NewClient("tcp://localhost:"+mosquittoPort, clientId)
+	return "tcp://localhost:" + mosquittoPort
+}
+
+// createHostClient creates a host client for the federator
+// it connects to the local mosquitto broker
+func createHostClient(clientId string, version int) *paho.Client {
+	fmt.Println("Creating host client as ", clientId)
+
+	mqttClient, err := paho.NewClientVersion(hostBroker(), clientId, version)
 
 	if err != nil {
 		panic(err)
@@ -187,12 +587,15 @@ func createHostClient(clientId string) *paho.Client {
 	return mqttClient
 }
 
+// TOPOLOGY_BROKER is the broker of the topology manager
+const TOPOLOGY_BROKER = "tcp://topology-manager:1883"
+
 // createTopologyClient creates a client for the federator
 // that connects to the topology manager
 func createTopologyClient(clientId string) *paho.Client {
 	fmt.Println("Creating topology client as ", clientId)
 
-	mqttClient, err := paho.NewClient("tcp://topology-manager:1883", clientId)
+	mqttClient, err := paho.NewClient(TOPOLOGY_BROKER, clientId)
 
 	if err != nil {
 		fmt.Println("Error on creating topology client: ", err)
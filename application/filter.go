@@ -0,0 +1,59 @@
+package application
+
+import (
+	"strings"
+)
+
+const SINGLE_LEVEL_WILDCARD = "+"
+const MULTI_LEVEL_WILDCARD = "#"
+
+// MQTT does not allow wildcards in the topic of a publication,
+// so filters are escaped when they are part of a federator topic
+// (beacons, core anns, memb anns and routed pubs)
+var topicEscaper = strings.NewReplacer("%", "%25", "+", "%2B", "#", "%23")
+var topicUnescaper = strings.NewReplacer("%25", "%", "%2B", "+", "%23", "#")
+
+// EscapeTopic escapes the wildcards of a federated topic
+// so it can be used as part of a publication topic
+func EscapeTopic(topic string) string {
+	return topicEscaper.Replace(topic)
+}
+
+// UnescapeTopic reverts EscapeTopic
+func UnescapeTopic(topic string) string {
+	return topicUnescaper.Replace(topic)
+}
+
+// IsFilter checks if the federated topic has any wildcard level
+func IsFilter(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		if level == SINGLE_LEVEL_WILDCARD || level == MULTI_LEVEL_WILDCARD {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchFilter checks if a concrete topic matches an MQTT topic filter,
+// "+" matches exactly one level and "#" the remaining levels (including none)
+func MatchFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == MULTI_LEVEL_WILDCARD {
+			return i == len(filterLevels)-1
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != SINGLE_LEVEL_WILDCARD && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,74 @@
+package application
+
+import "testing"
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/temp", "sensors/temp", true},
+		{"sensors/temp", "sensors/hum", false},
+		{"sensors/+", "sensors/temp", true},
+		{"sensors/+", "sensors", false},
+		{"sensors/+", "sensors/room/temp", false},
+		{"sensors/+/temp", "sensors/room/temp", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/room/temp", true},
+		{"sensors/#", "actuators/room", false},
+		{"#", "sensors/temp", true},
+		{"+/#", "sensors", true},
+		{"sensors/#/temp", "sensors/room/temp", false},
+		{"sensors", "sensors/temp", false},
+	}
+
+	for _, test := range tests {
+		if got := MatchFilter(test.filter, test.topic); got != test.want {
+			t.Errorf("MatchFilter(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestEscapeTopic(t *testing.T) {
+	tests := []struct {
+		topic   string
+		escaped string
+	}{
+		{"sensors/temp", "sensors/temp"},
+		{"sensors/+/temp", "sensors/%2B/temp"},
+		{"sensors/#", "sensors/%23"},
+		{"100%/+", "100%25/%2B"},
+		{"%2B", "%252B"},
+	}
+
+	for _, test := range tests {
+		escaped := EscapeTopic(test.topic)
+
+		if escaped != test.escaped {
+			t.Errorf("EscapeTopic(%q) = %q, want %q", test.topic, escaped, test.escaped)
+		}
+
+		if topic := UnescapeTopic(escaped); topic != test.topic {
+			t.Errorf("UnescapeTopic(%q) = %q, want %q", escaped, topic, test.topic)
+		}
+	}
+}
+
+func TestIsFilter(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{"sensors/temp", false},
+		{"sensors/+", true},
+		{"sensors/#", true},
+		{"sensors/a+b", false},
+	}
+
+	for _, test := range tests {
+		if got := IsFilter(test.topic); got != test.want {
+			t.Errorf("IsFilter(%q) = %v, want %v", test.topic, got, test.want)
+		}
+	}
+}
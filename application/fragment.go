@@ -0,0 +1,202 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DEFAULT_MAX_MESSAGE_SIZE is used when the config does not set one,
+// it is below the usual broker message size limits
+const DEFAULT_MAX_MESSAGE_SIZE = 256 * 1024
+const MIN_FRAGMENT_SIZE = 512
+
+// MIN_MESSAGE_SIZE is the smallest max message size accepted, it fits a
+// fragment of MIN_FRAGMENT_SIZE bytes, base64 encoded, and its routed
+// pub header with room for the topic and the MQTT 5 properties
+const MIN_MESSAGE_SIZE = 2048
+const MAX_FRAGMENTS = 4096
+const REASSEMBLY_TIMEOUT = 10 * time.Second
+const MAX_PARTIAL_PUBS = 64
+
+// Fragment is the header of a routed pub that carries
+// only a part of the payload of the publication
+type Fragment struct {
+	Index int
+	Count int
+}
+
+// fragmentKey identifies a publication being reassembled, fragments are
+// split and joined on every hop so the sender is part of the key
+type fragmentKey struct {
+	Pub      TopicPubId
+	SenderId int64
+}
+
+// partialPub keeps the fragments received of a publication
+type partialPub struct {
+	Parts    [][]byte
+	Received int
+	Started  time.Time
+}
+
+// maxMessageSize returns the max message size or its default
+func (ctx *FederatorContext) maxMessageSize() int {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if ctx.MaxMessageSize <= 0 {
+		return DEFAULT_MAX_MESSAGE_SIZE
+	}
+
+	return ctx.MaxMessageSize
+}
+
+// checkMaxMessageSize rejects a configured max message size that does not
+// leave room for the smallest fragment, zero keeps the default
+func checkMaxMessageSize(size int) error {
+	if size != 0 && size < MIN_MESSAGE_SIZE {
+		return fmt.Errorf("max message size %d is below the minimum of %d", size, MIN_MESSAGE_SIZE)
+	}
+
+	return nil
+}
+
+// sendRoutedPub serializes a routed pub and sends it to the neighbors,
+// a payload that does not fit in the max message size is split in fragments
+func (t *TopicWorker) sendRoutedPub(routedPub RoutedPub, qos byte, ids []int64) {
+	topic, payload := routedPub.Serialize(t.Topic)
+	maxSize := t.Ctx.maxMessageSize()
+
+	if len(payload) <= maxSize {
+		t.sendTo(topic, payload, qos, ids)
+		return
+	}
+
+	// the payload is base64 encoded in the json, so only 3/4 of the
+	// space left by the rest of the message can be used by the chunk
+	header := routedPub
+	header.Payload = nil
+	header.Fragment = &Fragment{Index: MAX_FRAGMENTS, Count: MAX_FRAGMENTS}
+	overhead, _ := json.Marshal(&header)
+
+	// a larger chunk would make fragments the broker refuses
+	chunkSize := (maxSize - len(overhead)) / 4 * 3
+	if chunkSize < MIN_FRAGMENT_SIZE {
+		fmt.Println("Header of", len(overhead), "bytes leaves no room for a fragment, dropping")
+		t.Ctx.Metrics.Inc("fragment.header_too_large")
+		return
+	}
+
+	count := (len(routedPub.Payload) + chunkSize - 1) / chunkSize
+	if count > MAX_FRAGMENTS {
+		fmt.Println("Payload of", len(routedPub.Payload), "bytes is too large to fragment, dropping")
+		t.Ctx.Metrics.Inc("fragment.too_large")
+		return
+	}
+
+	for index := 0; index < count; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(routedPub.Payload) {
+			end = len(routedPub.Payload)
+		}
+
+		fragment := routedPub
+		fragment.Payload = routedPub.Payload[index*chunkSize : end]
+		fragment.Fragment = &Fragment{Index: index, Count: count}
+
+		topic, payload := fragment.Serialize(t.Topic)
+
+		// SendTo reorders the ids in place
+		t.sendTo(topic, payload, qos, append([]int64(nil), ids...))
+	}
+
+	t.Ctx.Metrics.Add("fragment.sent", int64(count))
+}
+
+// reassemble keeps a fragment of a routed pub, returns the whole
+// publication and true once every fragment has been received
+func (t *TopicWorker) reassemble(fragment RoutedPub) (RoutedPub, bool) {
+	header := fragment.Fragment
+
+	if header.Count <= 0 || header.Count > MAX_FRAGMENTS || header.Index < 0 || header.Index >= header.Count {
+		fmt.Println("Invalid fragment", header.Index, "of", header.Count, ", dropping")
+		return RoutedPub{}, false
+	}
+
+	key := fragmentKey{Pub: fragment.key(t.Topic), SenderId: fragment.SenderId}
+
+	partial, ok := t.Partials[key]
+	if !ok {
+		if len(t.Partials) >= MAX_PARTIAL_PUBS {
+			fmt.Println("Too many publications being reassembled, dropping fragment")
+			t.Ctx.Metrics.Inc("fragment.dropped")
+			return RoutedPub{}, false
+		}
+
+		partial = &partialPub{
+			Parts:   make([][]byte, header.Count),
+			Started: time.Now(),
+		}
+		t.Partials[key] = partial
+		t.scheduleReassemblyTick()
+	}
+
+	if len(partial.Parts) != header.Count || partial.Parts[header.Index] != nil {
+		return RoutedPub{}, false
+	}
+
+	partial.Parts[header.Index] = fragment.Payload
+	partial.Received += 1
+
+	if partial.Received < header.Count {
+		return RoutedPub{}, false
+	}
+
+	delete(t.Partials, key)
+
+	var payload []byte
+	for _, part := range partial.Parts {
+		payload = append(payload, part...)
+	}
+
+	routedPub := fragment
+	routedPub.Payload = payload
+	routedPub.Fragment = nil
+
+	t.Ctx.Metrics.Inc("fragment.reassembled")
+
+	return routedPub, true
+}
+
+// handleReassemblyTick drops the publications whose
+// fragments did not all arrive within the timeout
+func (t *TopicWorker) handleReassemblyTick() {
+	t.ReassemblyTimer = nil
+
+	for key, partial := range t.Partials {
+		if time.Since(partial.Started) > REASSEMBLY_TIMEOUT {
+			fmt.Println("Reassembly of", key.Pub, "timed out with", partial.Received, "of", len(partial.Parts), "fragments")
+			t.Ctx.Metrics.Inc("fragment.expired")
+			delete(t.Partials, key)
+		}
+	}
+
+	if len(t.Partials) > 0 {
+		t.scheduleReassemblyTick()
+	}
+}
+
+// scheduleReassemblyTick makes sure a reassembly tick is coming through the worker channel
+func (t *TopicWorker) scheduleReassemblyTick() {
+	if t.ReassemblyTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+
+	t.ReassemblyTimer = time.AfterFunc(REASSEMBLY_TIMEOUT/2, func() {
+		channel <- Message{Type: "ReassemblyTick", Topic: topic}
+	})
+}
@@ -0,0 +1,125 @@
+package application
+
+import (
+	"testing"
+	"time"
+)
+
+// fragmentOf returns a fragment of the pub 1 of origin 2 sent by a neighbor
+func fragmentOf(senderId int64, index int, count int, payload string) RoutedPub {
+	return RoutedPub{
+		Topic:    "sensors/temp",
+		SenderId: senderId,
+		PubId:    PubId{OriginId: 2, Seqn: 1},
+		Payload:  []byte(payload),
+		Fragment: &Fragment{Index: index, Count: count},
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments []RoutedPub
+		payload   string
+		complete  bool
+		partials  int
+	}{
+		{"in order", []RoutedPub{fragmentOf(3, 0, 2, "ab"), fragmentOf(3, 1, 2, "cd")}, "abcd", true, 0},
+		{"out of order", []RoutedPub{fragmentOf(3, 1, 2, "cd"), fragmentOf(3, 0, 2, "ab")}, "abcd", true, 0},
+		{"missing fragment", []RoutedPub{fragmentOf(3, 0, 3, "ab"), fragmentOf(3, 2, 3, "ef")}, "", false, 1},
+		{"duplicate fragment", []RoutedPub{fragmentOf(3, 0, 2, "ab"), fragmentOf(3, 0, 2, "ab")}, "", false, 1},
+		{"count changed", []RoutedPub{fragmentOf(3, 0, 2, "ab"), fragmentOf(3, 1, 3, "cd")}, "", false, 1},
+		{"per sender", []RoutedPub{fragmentOf(3, 0, 2, "ab"), fragmentOf(4, 1, 2, "cd")}, "", false, 2},
+		{"index out of range", []RoutedPub{fragmentOf(3, 2, 2, "ab")}, "", false, 0},
+		{"negative index", []RoutedPub{fragmentOf(3, -1, 2, "ab")}, "", false, 0},
+		{"too many fragments", []RoutedPub{fragmentOf(3, 0, MAX_FRAGMENTS+1, "ab")}, "", false, 0},
+	}
+
+	for _, test := range tests {
+		worker := newTestWorker("sensors/temp")
+
+		var routedPub RoutedPub
+		var complete bool
+
+		for _, fragment := range test.fragments {
+			routedPub, complete = worker.reassemble(fragment)
+		}
+
+		if worker.ReassemblyTimer != nil {
+			worker.ReassemblyTimer.Stop()
+		}
+
+		if complete != test.complete || string(routedPub.Payload) != test.payload {
+			t.Errorf("%s: complete %v with %q, want %v with %q", test.name, complete, routedPub.Payload, test.complete, test.payload)
+		}
+
+		if complete && routedPub.Fragment != nil {
+			t.Errorf("%s: reassembled pub keeps its fragment header", test.name)
+		}
+
+		if len(worker.Partials) != test.partials {
+			t.Errorf("%s: %d partial pubs, want %d", test.name, len(worker.Partials), test.partials)
+		}
+	}
+}
+
+func TestReassembleLimit(t *testing.T) {
+	worker := newTestWorker("sensors/temp")
+
+	for senderId := int64(0); senderId < MAX_PARTIAL_PUBS+1; senderId++ {
+		worker.reassemble(fragmentOf(senderId, 0, 2, "ab"))
+	}
+
+	worker.ReassemblyTimer.Stop()
+
+	if len(worker.Partials) != MAX_PARTIAL_PUBS {
+		t.Fatalf("%d partial pubs, want %d", len(worker.Partials), MAX_PARTIAL_PUBS)
+	}
+
+	if dropped := worker.Ctx.Metrics.Counter("fragment.dropped"); dropped != 1 {
+		t.Fatalf("%d fragments dropped, want 1", dropped)
+	}
+}
+
+func TestReassemblyTimeout(t *testing.T) {
+	worker := newTestWorker("sensors/temp")
+
+	worker.reassemble(fragmentOf(3, 0, 2, "ab"))
+	worker.reassemble(fragmentOf(4, 0, 2, "ab"))
+	worker.ReassemblyTimer.Stop()
+
+	for key, partial := range worker.Partials {
+		if key.SenderId == 3 {
+			partial.Started = time.Now().Add(-2 * REASSEMBLY_TIMEOUT)
+		}
+	}
+
+	worker.handleReassemblyTick()
+	worker.ReassemblyTimer.Stop()
+
+	if len(worker.Partials) != 1 {
+		t.Fatalf("%d partial pubs after the timeout, want 1", len(worker.Partials))
+	}
+
+	if expired := worker.Ctx.Metrics.Counter("fragment.expired"); expired != 1 {
+		t.Fatalf("%d reassemblies expired, want 1", expired)
+	}
+}
+
+func TestCheckMaxMessageSize(t *testing.T) {
+	tests := []struct {
+		size int
+		ok   bool
+	}{
+		{0, true},
+		{MIN_MESSAGE_SIZE - 1, false},
+		{MIN_MESSAGE_SIZE, true},
+		{DEFAULT_MAX_MESSAGE_SIZE, true},
+	}
+
+	for _, test := range tests {
+		if err := checkMaxMessageSize(test.size); (err == nil) != test.ok {
+			t.Errorf("checkMaxMessageSize(%d) = %v, want ok %v", test.size, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package application
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DEFAULT_PING_INTERVAL is used when the config does not set one
+const DEFAULT_PING_INTERVAL = 2 * time.Second
+const LOSS_WINDOW = 10
+
+// QUALITY_MARGIN is how much better a link must be to replace a parent,
+// it keeps the parents from flapping between links of similar quality
+const QUALITY_MARGIN = 0.2
+
+// LinkQuality is a struct that
+// summarizes the pings sent to a neighbor
+type LinkQuality struct {
+	RTT  time.Duration `json:"rtt"`  // smoothed round trip time
+	Loss float64       `json:"loss"` // unanswered pings in the last LOSS_WINDOW
+}
+
+// linkProbe keeps the pings of a neighbor
+type linkProbe struct {
+	Seqn        int
+	RTT         time.Duration
+	Outstanding map[int]time.Time
+	Results     []bool // answered or not, of the last pings
+	Cost        int    // measured cost last reported, see measuredCost
+}
+
+// LinkMonitor is a struct that
+// measures the RTT and loss of the
+// neighbor links with ping exchanges,
+// it is safe for concurrent use
+type LinkMonitor struct {
+	mu     sync.Mutex
+	probes map[int64]*linkProbe
+}
+
+// NewLinkMonitor creates a new LinkMonitor instance
+func NewLinkMonitor() *LinkMonitor {
+	return &LinkMonitor{probes: make(map[int64]*linkProbe)}
+}
+
+// next returns the sequence of the next ping to a neighbor, the pings
+// that were not answered within the timeout are counted as lost
+func (m *LinkMonitor) next(neighborId int64, timeout time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probe, ok := m.probes[neighborId]
+	if !ok {
+		probe = &linkProbe{Outstanding: make(map[int]time.Time)}
+		m.probes[neighborId] = probe
+	}
+
+	for seqn, sentAt := range probe.Outstanding {
+		if time.Since(sentAt) > timeout {
+			delete(probe.Outstanding, seqn)
+			probe.record(false)
+		}
+	}
+
+	probe.Seqn += 1
+	probe.Outstanding[probe.Seqn] = time.Now()
+
+	return probe.Seqn
+}
+
+// answered records the pong of a ping, returns the measured round trip time
+func (m *LinkMonitor) answered(neighborId int64, seqn int) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probe, ok := m.probes[neighborId]
+	if !ok {
+		return 0, false
+	}
+
+	sentAt, ok := probe.Outstanding[seqn]
+	if !ok {
+		return 0, false
+	}
+
+	delete(probe.Outstanding, seqn)
+
+	rtt := time.Since(sentAt)
+	if probe.RTT == 0 {
+		probe.RTT = rtt
+	} else {
+		probe.RTT = (7*probe.RTT + rtt) / 8
+	}
+
+	probe.record(true)
+
+	return rtt, true
+}
+
+func (p *linkProbe) record(answered bool) {
+	p.Results = append(p.Results, answered)
+
+	if len(p.Results) > LOSS_WINDOW {
+		p.Results = p.Results[len(p.Results)-LOSS_WINDOW:]
+	}
+}
+
+// Quality returns the quality of the link to a neighbor,
+// false if no ping was answered yet
+func (m *LinkMonitor) Quality(neighborId int64) (LinkQuality, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probe, ok := m.probes[neighborId]
+	if !ok || probe.RTT == 0 {
+		return LinkQuality{}, false
+	}
+
+	lost := 0
+	for _, answered := range probe.Results {
+		if !answered {
+			lost += 1
+		}
+	}
+
+	return LinkQuality{
+		RTT:  probe.RTT,
+		Loss: float64(lost) / float64(len(probe.Results)),
+	}, true
+}
+
+// cost combines the RTT and loss of a link, a lost ping
+// costs about as much as a retransmission
+func (q LinkQuality) cost() float64 {
+	if q.Loss >= 1 {
+		return math.Inf(1)
+	}
+
+	return q.RTT.Seconds() / (1 - q.Loss)
+}
+
+// cost returns the cost of the link to a neighbor, an unmeasured link costs the most
+func (m *LinkMonitor) cost(neighborId int64) float64 {
+	quality, ok := m.Quality(neighborId)
+	if !ok {
+		return math.Inf(1)
+	}
+
+	return quality.cost()
+}
+
+// measuredCost returns the measured cost of the link to a neighbor in
+// MEASURED_COST_UNIT, false if the link is not measured yet. The distance
+// of the core anns only matches between rounds if the cost is stable, so
+// the reported cost only moves when the measurement leaves it by more than
+// a unit and QUALITY_MARGIN, the jitter of the RTT is not passed on
+func (m *LinkMonitor) measuredCost(neighborId int64) (int, bool) {
+	quality, ok := m.Quality(neighborId)
+	if !ok {
+		return 0, false
+	}
+
+	cost := MAX_LINK_COST
+	if units := quality.cost() / MEASURED_COST_UNIT.Seconds(); units < MAX_LINK_COST {
+		cost = DEFAULT_LINK_COST + int(units)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probe := m.probes[neighborId]
+
+	if probe.Cost != 0 && math.Abs(float64(cost-probe.Cost)) <= math.Max(1, float64(probe.Cost)*QUALITY_MARGIN) {
+		return probe.Cost, true
+	}
+
+	probe.Cost = cost
+
+	return cost, true
+}
+
+// Better checks if the link to the candidate is clearly better than the
+// link to the current neighbor, an unmeasured candidate is never better
+func (m *LinkMonitor) Better(candidate int64, current int64) bool {
+	if _, ok := m.Quality(candidate); !ok {
+		return false
+	}
+
+	return m.cost(candidate) < m.cost(current)*(1-QUALITY_MARGIN)
+}
+
+// pingInterval returns the ping interval or its default
+func (ctx *FederatorContext) pingInterval() time.Duration {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if ctx.PingInterval <= 0 {
+		return DEFAULT_PING_INTERVAL
+	}
+
+	return ctx.PingInterval
+}
+
+// probeLinks pings every neighbor on each ping interval, it ranges
+// over a snapshot because neighbors come and go while it sleeps
+func (f *Federator) probeLinks() {
+	for {
+		interval := f.Ctx.pingInterval()
+		time.Sleep(interval)
+
+		for id, neighbor := range f.Ctx.neighbors() {
+			ping := Ping{
+				SenderId: f.Ctx.id(),
+				Seqn:     f.Ctx.Links.next(id, 2*interval),
+			}
+
+			topic, payload := ping.Serialize()
+
+			if err := neighbor.PublishAsync(topic, string(payload), 0, false); err != nil {
+				fmt.Println("error while send ping to", id)
+			}
+		}
+	}
+}
+
+// handlePing answers the ping of a neighbor with a pong
+func (f *Federator) handlePing(ping Ping) {
+	neighbor := f.Ctx.neighbor(ping.SenderId)
+	if neighbor == nil {
+		return
+	}
+
+	pong := Pong{
+		SenderId: f.Ctx.id(),
+		Seqn:     ping.Seqn,
+	}
+
+	topic, payload := pong.Serialize()
+
+	if err := neighbor.PublishAsync(topic, string(payload), 0, false); err != nil {
+		fmt.Println("error while send pong to", ping.SenderId)
+	}
+}
+
+// handlePong records the round trip time of an answered ping
+func (f *Federator) handlePong(pong Pong) {
+	rtt, ok := f.Ctx.Links.answered(pong.SenderId, pong.Seqn)
+
+	if ok {
+		f.Ctx.Metrics.Observe("link."+strconv.FormatInt(pong.SenderId, 10)+".rtt", rtt)
+	}
+}
+
+// worstParent returns the index of the parent with the worst link
+func (t TopicWorker) worstParent(parents []Parent) int {
+	worst := 0
+
+	for i := range parents {
+		if t.Ctx.Links.cost(parents[i].Id) > t.Ctx.Links.cost(parents[worst].Id) {
+			worst = i
+		}
+	}
+
+	return worst
+}
+
+// isParent checks if the neighbor is one of the parents
+func isParent(parents []Parent, id int64) bool {
+	for _, parent := range parents {
+		if parent.Id == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addParent makes a neighbor parent towards the core of the core ann,
+// it is answered right away when there are local subscribers
+func (t *TopicWorker) addParent(coreAnn CoreAnn, id int64) {
+	wasAnswered := false
+
+	// check if the neighbor has local subscribers
+	if hasLocalSub(t.LatestBeacon, t.Ctx) {
+		coreAnn.SenderId = id
+		answer(coreAnn, t.Topic, t.Ctx)
+		wasAnswered = true
+	}
+
+	fmt.Println("Adding parent ", id, " to ", t.Ctx.id())
+
+	t.CurrentCore.Other.Parents = append(t.CurrentCore.Other.Parents, Parent{
+		Id:          id,
+		WasAnswered: wasAnswered,
+	})
+	t.CurrentCore.Other.HasUnansweredParents = t.CurrentCore.Other.HasUnansweredParents || !wasAnswered
+}
+
+// addCandidate remembers a neighbor at the parents distance
+// that was not taken as parent in the current round
+func (t *TopicWorker) addCandidate(id int64) {
+	for _, candidate := range t.CurrentCore.Other.Candidates {
+		if candidate == id {
+			return
+		}
+	}
+
+	t.CurrentCore.Other.Candidates = append(t.CurrentCore.Other.Candidates, id)
+}
+
+// rankParents swaps the parent with the worst link for the best candidate
+// when the candidate link is clearly better, one swap per core ann so the
+// parents do not flap on a single measure
+func (t *TopicWorker) rankParents(coreAnn CoreAnn) {
+	core := &t.CurrentCore.Other
+
+	if len(core.Parents) == 0 || len(core.Candidates) == 0 {
+		return
+	}
+
+	best := 0
+	for i := range core.Candidates {
+		if t.Ctx.Links.cost(core.Candidates[i]) < t.Ctx.Links.cost(core.Candidates[best]) {
+			best = i
+		}
+	}
+
+	worst := t.worstParent(core.Parents)
+	evicted := core.Parents[worst]
+	promoted := core.Candidates[best]
+
+	if !t.Ctx.Links.Better(promoted, evicted.Id) {
+		return
+	}
+
+	fmt.Println("Replacing parent ", evicted.Id, " by ", promoted, " with a better link")
+	t.Ctx.Metrics.Inc("mesh.parent_swaps")
+
+	parents := append([]Parent{}, core.Parents[:worst]...)
+	core.Parents = append(parents, core.Parents[worst+1:]...)
+
+	// the evicted parent stays a candidate, it can come back if its link recovers
+	core.Candidates[best] = evicted.Id
+
+	// the evicted parent stops sending right away
+	if evicted.WasAnswered {
+		t.sendLeave(evicted.Id, core.Id)
+	}
+
+	t.addParent(coreAnn, promoted)
+}
@@ -0,0 +1,230 @@
+package application
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// setRTT makes a neighbor look measured with the given RTT and no loss
+func setRTT(m *LinkMonitor, neighborId int64, rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	probe, ok := m.probes[neighborId]
+	if !ok {
+		probe = &linkProbe{Outstanding: make(map[int]time.Time), Results: []bool{true}}
+		m.probes[neighborId] = probe
+	}
+
+	probe.RTT = rtt
+}
+
+func TestMeasuredCostIgnoresJitter(t *testing.T) {
+	links := NewLinkMonitor()
+
+	if _, ok := links.measuredCost(2); ok {
+		t.Fatal("unmeasured link has a cost")
+	}
+
+	steps := []struct {
+		rtt  time.Duration
+		want int
+	}{
+		{50 * time.Millisecond, 6},
+		{61 * time.Millisecond, 6}, // jitter across a unit boundary
+		{41 * time.Millisecond, 6}, // and back
+		{70 * time.Millisecond, 8}, // a real change moves it
+		{150 * time.Millisecond, 16},
+	}
+
+	for _, step := range steps {
+		setRTT(links, 2, step.rtt)
+
+		if cost, _ := links.measuredCost(2); cost != step.want {
+			t.Fatalf("cost %d after RTT %s, want %d", cost, step.rtt, step.want)
+		}
+	}
+}
+
+// ping sends a ping to a neighbor and answers it as if it took rtt,
+// a zero rtt leaves it unanswered
+func ping(m *LinkMonitor, neighborId int64, rtt time.Duration) {
+	seqn := m.next(neighborId, time.Second)
+
+	if rtt == 0 {
+		m.mu.Lock()
+		m.probes[neighborId].Outstanding[seqn] = time.Now().Add(-time.Minute)
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	m.probes[neighborId].Outstanding[seqn] = time.Now().Add(-rtt)
+	m.mu.Unlock()
+
+	m.answered(neighborId, seqn)
+}
+
+func TestLinkMonitorQuality(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name string
+		rtts []time.Duration // zero for a lost ping
+		rtt  time.Duration
+		loss float64
+	}{
+		{"first answer", []time.Duration{80 * ms}, 80 * ms, 0},
+		{"smoothed", []time.Duration{80 * ms, 160 * ms}, 90 * ms, 0},
+		// the lost ping is only counted by the next ping
+		{"one lost", []time.Duration{80 * ms, 0, 80 * ms}, 80 * ms, 1.0 / 3},
+		{"window", []time.Duration{0, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms, 80 * ms}, 80 * ms, 0},
+	}
+
+	for _, test := range tests {
+		links := NewLinkMonitor()
+
+		for _, rtt := range test.rtts {
+			ping(links, 2, rtt)
+		}
+
+		quality, ok := links.Quality(2)
+		if !ok {
+			t.Errorf("%s: link not measured", test.name)
+			continue
+		}
+
+		if quality.RTT < test.rtt || quality.RTT > test.rtt+5*ms {
+			t.Errorf("%s: RTT %s, want %s", test.name, quality.RTT, test.rtt)
+		}
+
+		if math.Abs(quality.Loss-test.loss) > 0.001 {
+			t.Errorf("%s: loss %v, want %v", test.name, quality.Loss, test.loss)
+		}
+	}
+}
+
+func TestLinkMonitorUnanswered(t *testing.T) {
+	links := NewLinkMonitor()
+
+	if _, ok := links.Quality(2); ok {
+		t.Fatal("unknown link is measured")
+	}
+
+	if _, ok := links.answered(2, 1); ok {
+		t.Fatal("pong of an unknown link accepted")
+	}
+
+	ping(links, 2, 0)
+
+	if _, ok := links.Quality(2); ok {
+		t.Fatal("link without answers is measured")
+	}
+}
+
+func TestLinkQualityCost(t *testing.T) {
+	tests := []struct {
+		quality LinkQuality
+		cost    float64
+	}{
+		{LinkQuality{RTT: 100 * time.Millisecond}, 0.1},
+		{LinkQuality{RTT: 100 * time.Millisecond, Loss: 0.5}, 0.2},
+		{LinkQuality{RTT: 100 * time.Millisecond, Loss: 1}, math.Inf(1)},
+	}
+
+	for _, test := range tests {
+		if cost := test.quality.cost(); math.Abs(cost-test.cost) > 1e-9 && cost != test.cost {
+			t.Errorf("%+v: cost %v, want %v", test.quality, cost, test.cost)
+		}
+	}
+}
+
+func TestLinkMonitorBetter(t *testing.T) {
+	tests := []struct {
+		name      string
+		candidate time.Duration // zero for an unmeasured link
+		current   time.Duration
+		want      bool
+	}{
+		{"clearly better", 50 * time.Millisecond, 100 * time.Millisecond, true},
+		{"within the margin", 90 * time.Millisecond, 100 * time.Millisecond, false},
+		{"worse", 150 * time.Millisecond, 100 * time.Millisecond, false},
+		{"unmeasured candidate", 0, 100 * time.Millisecond, false},
+		{"unmeasured current", 100 * time.Millisecond, 0, true},
+	}
+
+	for _, test := range tests {
+		links := NewLinkMonitor()
+
+		if test.candidate > 0 {
+			setRTT(links, 2, test.candidate)
+		}
+		if test.current > 0 {
+			setRTT(links, 3, test.current)
+		}
+
+		if got := links.Better(2, 3); got != test.want {
+			t.Errorf("%s: Better = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRankParents(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name       string
+		parents    []int64
+		candidates []int64
+		rtts       map[int64]time.Duration
+		wantParent []int64
+		wantCands  []int64
+	}{
+		{"no candidates", []int64{2}, nil, map[int64]time.Duration{2: 100 * ms}, []int64{2}, nil},
+		{"better candidate", []int64{2}, []int64{3}, map[int64]time.Duration{2: 100 * ms, 3: 20 * ms}, []int64{3}, []int64{2}},
+		{"similar candidate", []int64{2}, []int64{3}, map[int64]time.Duration{2: 100 * ms, 3: 90 * ms}, []int64{2}, []int64{3}},
+		{"worst parent swapped", []int64{2, 4}, []int64{3}, map[int64]time.Duration{2: 10 * ms, 4: 100 * ms, 3: 20 * ms}, []int64{2, 3}, []int64{4}},
+		{"best candidate promoted", []int64{2}, []int64{3, 5}, map[int64]time.Duration{2: 100 * ms, 3: 40 * ms, 5: 20 * ms}, []int64{5}, []int64{3, 2}},
+		{"unmeasured parent swapped", []int64{2}, []int64{3}, map[int64]time.Duration{3: 20 * ms}, []int64{3}, []int64{2}},
+	}
+
+	for _, test := range tests {
+		worker := newTestWorker("sensors/temp")
+		worker.Ctx.Links = NewLinkMonitor()
+
+		for id, rtt := range test.rtts {
+			setRTT(worker.Ctx.Links, id, rtt)
+		}
+
+		for _, id := range test.parents {
+			worker.CurrentCore.Other.Parents = append(worker.CurrentCore.Other.Parents, Parent{Id: id})
+		}
+		worker.CurrentCore.Other.Candidates = test.candidates
+
+		worker.rankParents(CoreAnn{CoreId: 9, SenderId: 2})
+
+		var parents []int64
+		for _, parent := range worker.CurrentCore.Other.Parents {
+			parents = append(parents, parent.Id)
+		}
+
+		if !equalIds(parents, test.wantParent) || !equalIds(worker.CurrentCore.Other.Candidates, test.wantCands) {
+			t.Errorf("%s: parents %v candidates %v, want %v and %v", test.name, parents, worker.CurrentCore.Other.Candidates, test.wantParent, test.wantCands)
+		}
+	}
+}
+
+func equalIds(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -7,8 +7,7 @@ import (
 	"strings"
 
 	keys "mqtt-fed/infra/crypto"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	paho "mqtt-fed/infra/queue"
 )
 
 const TOPOLOGY_ANN_LEVEL = "federator/topology_ann"
@@ -22,9 +21,17 @@ const SECURE_BEACON_TOPIC_LEVEL = "federator/beacon/s/"
 const CORE_ANNS = "federator/core_ann/#"
 const CORE_ANN_TOPIC_LEVEL = "federator/core_ann/"
 
+const CORE_WITHDRAWALS = "federator/core_withdraw/#"
+const CORE_WITHDRAWAL_TOPIC_LEVEL = "federator/core_withdraw/"
+
+var ErrCoreAnnCleared = errors.New("retained core ann cleared")
+
 const MEMB_ANNS = "federator/memb_ann/#"
 const MEMB_ANN_TOPIC_LEVEL = "federator/memb_ann/"
 
+const MEMB_LEAVES = "federator/memb_leave/#"
+const MEMB_LEAVE_TOPIC_LEVEL = "federator/memb_leave/"
+
 const MEMB_ACK = "federator/memb_ack/#"
 const MEMB_ACK_TOPIC_LEVEL = "federator/memb_ack/"
 
@@ -33,6 +40,28 @@ const SECURE_FEDERATED_TOPICS = "federated/s/#"
 const FEDERATED_TOPICS_LEVEL = "federated/"
 const SECURE_FEDERATED_TOPICS_LEVEL = "federated/s/"
 
+const ROUTING_ACKS = "federator/routing_ack/#"
+const ROUTING_ACK_TOPIC_LEVEL = "federator/routing_ack/"
+
+const BATCH_TOPIC = "federator/batch"
+
+const TRACE_REQUESTS = "federator/trace_request/#"
+const TRACE_REQUEST_LEVEL = "federator/trace_request/"
+const TRACES = "federator/trace/#"
+const TRACE_LEVEL = "federator/trace/"
+const TRACE_REPLIES = "federator/trace_reply/#"
+const TRACE_REPLY_LEVEL = "federator/trace_reply/"
+
+// TRACE_RESULT_LEVEL prefixes the reply topics of the trace requesters,
+// the federators do not subscribe to it
+const TRACE_RESULT_LEVEL = "federator/trace_result/"
+
+const PING_TOPIC = "federator/ping"
+const PONG_TOPIC = "federator/pong"
+
+const NACKS = "federator/nack/#"
+const NACK_TOPIC_LEVEL = "federator/nack/"
+
 const ROUTING_TOPICS = "federator/routing/#"
 const SECURE_ROUTING_TOPICS = "federator/routing/s/#"
 const ROUTING_TOPICS_LEVEL = "federator/routing/"
@@ -46,12 +75,22 @@ type Message struct {
 	FederatedPub
 	SecureFederatedPub
 	RoutedPub
+	RoutedPubAck
+	MeshNack
+	CoreWithdrawal
 	SecureRoutedPub
 	CoreAnn
 	MeshMembAnn
 	MeshMembAck
+	MeshMembLeave
+	Ping
+	Pong
+	TraceRequest
+	Trace
+	TraceReply
 	Beacon
 	SecureBeacon
+	LinkLost int64 // Neighbor whose connection was lost, internal to the federator
 }
 
 type TopologyAnn struct {
@@ -67,25 +106,110 @@ type NodeAnn struct {
 }
 
 type RoutedPub struct {
+	PubId      PubId
+	SenderId   int64
+	Topic      string           `json:",omitempty"` // Concrete topic when routed over a filter mesh
+	Qos        byte             // QoS of the original publication
+	Retain     bool             // Retain flag of the original publication
+	Reliable   bool             `json:",omitempty"` // Every hop acknowledges the pub and retransmits it until acknowledged
+	Fragment   *Fragment        `json:",omitempty"` // Set when the payload is split over several messages
+	Encoding   string           `json:",omitempty"` // Compression of the payload, empty when sent as is
+	TTL        int              `json:",omitempty"` // Hops left, decremented on every forward, absent from federators that predate it
+	Timestamp  int64            `json:",omitempty"` // Origin time in unix nanoseconds, the message expiry counts from it
+	Properties *paho.Properties `json:",omitempty"` // MQTT 5 properties of the original publication
+	Payload    []byte
+	admitted   bool // took its rate limit token before a delay, never sent
+}
+
+type RoutedPubAck struct {
 	PubId    PubId
+	Topic    string `json:",omitempty"` // Concrete topic when routed over a filter mesh
 	SenderId int64
-	Payload  []byte
 }
 
-type SecureRoutedPub struct {
-	PubId    PubId
+type TraceRequest struct {
+	TraceId    string
+	ReplyTopic string // Where the replies are published on the host broker of the requester
+}
+
+type Trace struct {
+	TraceId    string
+	ReplyTopic string
+	SenderId   int64
+	TTL        int
+	Hops       []TraceHop
+}
+
+type TraceHop struct {
+	FederatorId int64
+	Role        string // core, parent or child of the previous hop, member when unrelated
+	LocalSub    bool   // The federator has local subscribers
+	Timestamp   int64  // Unix nanoseconds when the trace reached the federator
+}
+
+type TraceReply struct {
+	TraceId    string
+	ReplyTopic string
+	Hops       []TraceHop // Path from the requester to the replying federator
+}
+
+type Ping struct {
 	SenderId int64
-	Payload  []byte
-	Mac      []byte
+	Seqn     int
+}
+
+type Pong struct {
+	SenderId int64
+	Seqn     int // Sequence of the answered ping
+}
+
+type RoutedBatch struct {
+	SenderId int64
+	Messages []BatchedMessage
+}
+
+type BatchedMessage struct {
+	Topic   string
+	Qos     byte
+	Payload json.RawMessage // Routed pubs are json, so they are embedded as is
+}
+
+type MeshNack struct {
+	SenderId int64
+	Topic    string `json:",omitempty"` // Concrete topic when routed over a filter mesh
+	OriginId int64
+	Epoch    int64 `json:",omitempty"` // Start time of the origin the sequences belong to
+	Seqns    []int // Missing sequences of the origin stream
+}
+
+type SecureRoutedPub struct {
+	PubId      PubId
+	SenderId   int64
+	Timestamp  int64            // Origin time in unix nanoseconds, covered by the MAC
+	Qos        byte             // QoS of the original publication
+	Retain     bool             // Retain flag of the original publication
+	Properties *paho.Properties `json:",omitempty"` // MQTT 5 properties, covered by the MAC
+	Encoding   string           `json:",omitempty"` // Compression of the plaintext, covered by the MAC
+	TTL        int              `json:",omitempty"` // Hops left, decremented on every forward, absent from federators that predate it
+	Payload    []byte
+	Mac        []byte
 }
 
 type FederatedPub struct {
-	Payload []byte
+	PubId      PubId  // Assigned by the federator, shared by every mesh the pub is routed on
+	Topic      string // Concrete topic the pub was published on
+	Qos        byte
+	Retain     bool
+	Properties *paho.Properties
+	Payload    []byte
 }
 
 type SecureFederatedPub struct {
-	Payload []byte
-	Mac     []byte
+	Qos        byte
+	Retain     bool
+	Properties *paho.Properties
+	Payload    []byte
+	Mac        []byte
 }
 
 type CoreAnn struct {
@@ -93,6 +217,12 @@ type CoreAnn struct {
 	SenderId int64
 	Seqn     int
 	Dist     int
+	Priority int `json:",omitempty"` // Election priority of the core
+}
+
+type CoreWithdrawal struct {
+	CoreId   int64
+	SenderId int64
 }
 
 type MeshMembAnn struct {
@@ -102,6 +232,11 @@ type MeshMembAnn struct {
 	PublicKey []byte // My public key to be used by the sender to generate the shared key
 }
 
+type MeshMembLeave struct {
+	CoreId   int64
+	SenderId int64
+}
+
 type MeshMembAck struct {
 	CoreId     int64
 	SenderId   int64
@@ -112,9 +247,18 @@ type MeshMembAck struct {
 
 type PubId struct {
 	OriginId int64
+	Epoch    int64 `json:",omitempty"` // Start time of the origin, its sequences begin again with it
 	Seqn     int
 }
 
+// TopicPubId identifies a publication across meshes, the sequence
+// of a PubId is per concrete topic so two topics matching the same
+// filter can have equal PubIds
+type TopicPubId struct {
+	Topic string
+	PubId PubId
+}
+
 type Beacon struct {
 	Payload []byte
 }
@@ -126,7 +270,7 @@ type SecureBeacon struct {
 // Deserialize deserializes a message from an MQTT message
 // mqttMessage: the MQTT message
 // returns the deserialized message and an error
-func (f *Federator) Deserialize(mqttMessage mqtt.Message) (*Message, error) {
+func (f *Federator) Deserialize(mqttMessage paho.Message) (*Message, error) {
 	topic := mqttMessage.Topic()
 
 	message := Message{}
@@ -139,26 +283,75 @@ func (f *Federator) Deserialize(mqttMessage mqtt.Message) (*Message, error) {
 
 	if strings.HasPrefix(topic, NODE_ANN_LEVEL) {
 		message.Type = "NodeAnn"
-		payload, _ := keys.Decrypt(mqttMessage.Payload(), f.Ctx.SharedKey)
-		err = json.Unmarshal(payload, &message.NodeAnn)
+		payload, decryptErr := keys.Decrypt(mqttMessage.Payload(), f.Ctx.sharedKey())
+
+		// every node ann, the unknown node signal included, must come from
+		// the topology manager, a topology manager that lost our key is
+		// noticed by the heartbeats instead
+		if decryptErr != nil {
+			err = decryptErr
+		} else {
+			err = json.Unmarshal(payload, &message.NodeAnn)
+		}
+
 		message.Topic = message.NodeAnn.Topic
 
 		fmt.Println("->", message.Type, "Payload:", message.NodeAnn)
 	} else if strings.HasPrefix(topic, TOPOLOGY_ANN_LEVEL) {
 		message.Type = "TopologyAnn"
-		payload, _ := keys.Decrypt(mqttMessage.Payload(), f.Ctx.SharedKey)
+		payload, _ := keys.Decrypt(mqttMessage.Payload(), f.Ctx.sharedKey())
 		err = json.Unmarshal(payload, &message.TopologyAnn)
 
 		fmt.Println("->", message.Type, "Payload:", message.TopologyAnn)
+	} else if strings.HasPrefix(topic, ROUTING_ACK_TOPIC_LEVEL) {
+		message.Type = "RoutedPubAck"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, ROUTING_ACK_TOPIC_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.RoutedPubAck)
+
+		fmt.Println("->", message.Type, "Payload:", message.RoutedPubAck)
+	} else if strings.HasPrefix(topic, TRACE_REQUEST_LEVEL) {
+		message.Type = "TraceRequest"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, TRACE_REQUEST_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.TraceRequest)
+
+		fmt.Println("->", message.Type, "Payload:", message.TraceRequest)
+	} else if strings.HasPrefix(topic, TRACE_REPLY_LEVEL) {
+		message.Type = "TraceReply"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, TRACE_REPLY_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.TraceReply)
+
+		fmt.Println("->", message.Type, "Payload:", message.TraceReply)
+	} else if strings.HasPrefix(topic, TRACE_LEVEL) {
+		message.Type = "Trace"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, TRACE_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.Trace)
+
+		fmt.Println("->", message.Type, "Payload:", message.Trace)
+	} else if topic == PING_TOPIC {
+		message.Type = "Ping"
+		err = json.Unmarshal(mqttMessage.Payload(), &message.Ping)
+
+		fmt.Println("->", message.Type, "Payload:", message.Ping)
+	} else if topic == PONG_TOPIC {
+		message.Type = "Pong"
+		err = json.Unmarshal(mqttMessage.Payload(), &message.Pong)
+
+		fmt.Println("->", message.Type, "Payload:", message.Pong)
+	} else if strings.HasPrefix(topic, NACK_TOPIC_LEVEL) {
+		message.Type = "MeshNack"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, NACK_TOPIC_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.MeshNack)
+
+		fmt.Println("->", message.Type, "Payload:", message.MeshNack)
 	} else if strings.HasPrefix(topic, SECURE_ROUTING_TOPICS_LEVEL) {
 		message.Type = "SecureRoutedPub"
-		message.Topic = strings.TrimPrefix(topic, SECURE_ROUTING_TOPICS_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, SECURE_ROUTING_TOPICS_LEVEL))
 		err = json.Unmarshal(mqttMessage.Payload(), &message.SecureRoutedPub)
 
 		fmt.Println("->", message.Type, "Payload:", message.SecureRoutedPub)
 	} else if strings.HasPrefix(topic, ROUTING_TOPICS_LEVEL) {
 		message.Type = "RoutedPub"
-		message.Topic = strings.TrimPrefix(topic, ROUTING_TOPICS_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, ROUTING_TOPICS_LEVEL))
 		err = json.Unmarshal(mqttMessage.Payload(), &message.RoutedPub)
 
 		fmt.Println("->", message.Type, "Payload:", message.RoutedPub)
@@ -166,41 +359,66 @@ func (f *Federator) Deserialize(mqttMessage mqtt.Message) (*Message, error) {
 		message.Type = "SecureFederatedPub"
 		message.Topic = strings.TrimPrefix(topic, SECURE_FEDERATED_TOPICS_LEVEL)
 		message.SecureFederatedPub.Payload = mqttMessage.Payload()
+		message.SecureFederatedPub.Properties = mqttMessage.Properties()
+		message.SecureFederatedPub.Qos = mqttMessage.Qos()
+		// only set on MQTT 5 host links, see ConsumeLive
+		message.SecureFederatedPub.Retain = mqttMessage.Retained()
 
 		fmt.Println("->", message.Type, "Payload:", string(message.SecureFederatedPub.Payload))
 	} else if strings.HasPrefix(topic, FEDERATED_TOPICS_LEVEL) {
 		message.Type = "FederatedPub"
 		message.Topic = strings.TrimPrefix(topic, FEDERATED_TOPICS_LEVEL)
 		message.FederatedPub.Payload = mqttMessage.Payload()
+		message.FederatedPub.Properties = mqttMessage.Properties()
+		message.FederatedPub.Qos = mqttMessage.Qos()
+		// only set on MQTT 5 host links, see ConsumeLive
+		message.FederatedPub.Retain = mqttMessage.Retained()
 
 		fmt.Println("->", message.Type, "Payload:", string(message.FederatedPub.Payload))
 	} else if strings.HasPrefix(topic, CORE_ANN_TOPIC_LEVEL) {
 		message.Type = "CoreAnn"
-		message.Topic = strings.TrimPrefix(topic, CORE_ANN_TOPIC_LEVEL)
-		err = json.Unmarshal(mqttMessage.Payload(), &message.CoreAnn)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, CORE_ANN_TOPIC_LEVEL))
+		// an empty payload is a resigned core clearing its retained core ann
+		if len(mqttMessage.Payload()) == 0 {
+			err = ErrCoreAnnCleared
+		} else {
+			err = json.Unmarshal(mqttMessage.Payload(), &message.CoreAnn)
+		}
 
 		fmt.Println("->", message.Type, "Payload:", message.CoreAnn)
+	} else if strings.HasPrefix(topic, CORE_WITHDRAWAL_TOPIC_LEVEL) {
+		message.Type = "CoreWithdrawal"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, CORE_WITHDRAWAL_TOPIC_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.CoreWithdrawal)
+
+		fmt.Println("->", message.Type, "Payload:", message.CoreWithdrawal)
+	} else if strings.HasPrefix(topic, MEMB_LEAVE_TOPIC_LEVEL) {
+		message.Type = "MeshMembLeave"
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, MEMB_LEAVE_TOPIC_LEVEL))
+		err = json.Unmarshal(mqttMessage.Payload(), &message.MeshMembLeave)
+
+		fmt.Println("->", message.Type, "Payload:", message.MeshMembLeave)
 	} else if strings.HasPrefix(topic, MEMB_ACK_TOPIC_LEVEL) {
 		message.Type = "MeshMembAck"
-		message.Topic = strings.TrimPrefix(topic, MEMB_ACK_TOPIC_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, MEMB_ACK_TOPIC_LEVEL))
 		err = json.Unmarshal(mqttMessage.Payload(), &message.MeshMembAck)
 
 		fmt.Println("->", message.Type, "Payload:", message.MeshMembAck)
 	} else if strings.HasPrefix(topic, MEMB_ANN_TOPIC_LEVEL) {
 		message.Type = "MeshMembAnn"
-		message.Topic = strings.TrimPrefix(topic, MEMB_ANN_TOPIC_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, MEMB_ANN_TOPIC_LEVEL))
 		err = json.Unmarshal(mqttMessage.Payload(), &message.MeshMembAnn)
 
 		fmt.Println("->", message.Type, "Payload:", message.MeshMembAnn)
 	} else if strings.HasPrefix(topic, SECURE_BEACON_TOPIC_LEVEL) {
 		message.Type = "SecureBeacon"
-		message.Topic = strings.TrimPrefix(topic, SECURE_BEACON_TOPIC_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, SECURE_BEACON_TOPIC_LEVEL))
 		message.Beacon.Payload = mqttMessage.Payload()
 
 		fmt.Println("->", message.Type, "Payload:", string(message.SecureBeacon.Payload))
 	} else if strings.HasPrefix(topic, BEACON_TOPIC_LEVEL) {
 		message.Type = "Beacon"
-		message.Topic = strings.TrimPrefix(topic, BEACON_TOPIC_LEVEL)
+		message.Topic = UnescapeTopic(strings.TrimPrefix(topic, BEACON_TOPIC_LEVEL))
 		message.Beacon.Payload = mqttMessage.Payload()
 
 		fmt.Println("->", message.Type, "Payload:", string(message.Beacon.Payload))
@@ -223,20 +441,118 @@ func (n *NodeAnn) Serialize(id string) (string, []byte) {
 	return topic, payload
 }
 
+// deliveryTopic returns the topic local subscribers receive the pub on,
+// the concrete topic for pubs routed over a filter mesh
+func (r *RoutedPub) deliveryTopic(meshTopic string) string {
+	if r.Topic != "" {
+		return r.Topic
+	}
+
+	return meshTopic
+}
+
+// key returns the id used to deduplicate the pub
+func (r *RoutedPub) key(meshTopic string) TopicPubId {
+	return TopicPubId{
+		Topic: r.deliveryTopic(meshTopic),
+		PubId: r.PubId,
+	}
+}
+
 // Serialize serializes a message to an MQTT message for RoutedPub
 // returns the topic and payload
 func (r *RoutedPub) Serialize(fedTopic string) (string, []byte) {
-	topic := ROUTING_TOPICS_LEVEL + fedTopic
+	topic := ROUTING_TOPICS_LEVEL + EscapeTopic(fedTopic)
 	payload, _ := json.Marshal(&r)
 
 	fmt.Println("Serialized RoutedPub: ", string(payload))
 	return topic, payload
 }
 
+// Serialize serializes a message to an MQTT message for RoutedPubAck
+// returns the topic and payload
+func (r *RoutedPubAck) Serialize(fedTopic string) (string, []byte) {
+	topic := ROUTING_ACK_TOPIC_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&r)
+
+	fmt.Println("Serialized RoutedPubAck: ", string(payload))
+	return topic, payload
+}
+
+// Serialize serializes a message to an MQTT message for TraceRequest
+// returns the topic and payload
+func (r *TraceRequest) Serialize(fedTopic string) (string, []byte) {
+	topic := TRACE_REQUEST_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&r)
+
+	return topic, payload
+}
+
+// Serialize serializes a message to an MQTT message for Trace
+// returns the topic and payload
+func (t *Trace) Serialize(fedTopic string) (string, []byte) {
+	topic := TRACE_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&t)
+
+	fmt.Println("Serialized Trace: ", string(payload))
+	return topic, payload
+}
+
+// Serialize serializes a message to an MQTT message for TraceReply
+// returns the topic and payload
+func (r *TraceReply) Serialize(fedTopic string) (string, []byte) {
+	topic := TRACE_REPLY_LEVEL + EscapeTopic(fedTopic)
+	payload, err := r.Payload()
+
+	if err != nil {
+		fmt.Println("Error serializing TraceReply:", err)
+	}
+
+	return topic, payload
+}
+
+// Payload returns the json of the trace reply
+func (r *TraceReply) Payload() ([]byte, error) {
+	return json.Marshal(&r)
+}
+
+// Serialize serializes a message to an MQTT message for Ping
+// returns the topic and payload
+func (p *Ping) Serialize() (string, []byte) {
+	payload, _ := json.Marshal(&p)
+	return PING_TOPIC, payload
+}
+
+// Serialize serializes a message to an MQTT message for Pong
+// returns the topic and payload
+func (p *Pong) Serialize() (string, []byte) {
+	payload, _ := json.Marshal(&p)
+	return PONG_TOPIC, payload
+}
+
+// Serialize serializes a message to an MQTT message for RoutedBatch
+// returns the topic and payload
+func (b *RoutedBatch) Serialize() (string, []byte) {
+	payload, _ := json.Marshal(&b)
+
+	fmt.Println("Serialized RoutedBatch with", len(b.Messages), "messages")
+	return BATCH_TOPIC, payload
+}
+
+// Serialize serializes a message to an MQTT message for MeshNack
+// returns the topic and payload
+func (n *MeshNack) Serialize(fedTopic string) (string, []byte) {
+	topic := NACK_TOPIC_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&n)
+
+	fmt.Println("Serialized MeshNack: ", string(payload))
+	return topic, payload
+}
+
 // Serialize serializes a message to an MQTT message for SecureRoutedPub
 // returns the topic and payload
 func (r *SecureRoutedPub) Serialize(fedTopic string) (string, []byte) {
-	topic := SECURE_ROUTING_TOPICS_LEVEL + fedTopic
+	topic := SECURE_ROUTING_TOPICS_LEVEL + EscapeTopic(fedTopic)
 	payload, _ := json.Marshal(&r)
 
 	fmt.Println("Serialized SecureRoutedPub: ", string(payload))
@@ -246,27 +562,47 @@ func (r *SecureRoutedPub) Serialize(fedTopic string) (string, []byte) {
 // Serialize serializes a message to an MQTT message for CoreAnn
 // returns the topic and payload
 func (c *CoreAnn) Serialize(fedTopic string) (string, []byte) {
-	topic := CORE_ANN_TOPIC_LEVEL + fedTopic
+	topic := CORE_ANN_TOPIC_LEVEL + EscapeTopic(fedTopic)
 	payload, _ := json.Marshal(&c)
 
 	fmt.Println("Serialized CoreAnn: ", string(payload))
 	return topic, payload
 }
 
+// Serialize serializes a message to an MQTT message for CoreWithdrawal
+// returns the topic and payload
+func (c *CoreWithdrawal) Serialize(fedTopic string) (string, []byte) {
+	topic := CORE_WITHDRAWAL_TOPIC_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&c)
+
+	fmt.Println("Serialized CoreWithdrawal: ", string(payload))
+	return topic, payload
+}
+
 // Serialize serializes a message to an MQTT message for MeshMembAnn
 // returns the topic and payload
 func (m *MeshMembAnn) Serialize(fedTopic string) (string, []byte) {
-	topic := MEMB_ANN_TOPIC_LEVEL + fedTopic
+	topic := MEMB_ANN_TOPIC_LEVEL + EscapeTopic(fedTopic)
 	payload, _ := json.Marshal(&m)
 
 	fmt.Println("Serialized MeshMembAnn: ", string(payload))
 	return topic, payload
 }
 
+// Serialize serializes a message to an MQTT message for MeshMembLeave
+// returns the topic and payload
+func (m *MeshMembLeave) Serialize(fedTopic string) (string, []byte) {
+	topic := MEMB_LEAVE_TOPIC_LEVEL + EscapeTopic(fedTopic)
+	payload, _ := json.Marshal(&m)
+
+	fmt.Println("Serialized MeshMembLeave: ", string(payload))
+	return topic, payload
+}
+
 // Serialize serializes a message to an MQTT message for MeshMembAnn
 // returns the topic and payload
 func (m *MeshMembAck) Serialize(fedTopic string) (string, []byte) {
-	topic := MEMB_ACK_TOPIC_LEVEL + fedTopic
+	topic := MEMB_ACK_TOPIC_LEVEL + EscapeTopic(fedTopic)
 	payload, _ := json.Marshal(&m)
 
 	fmt.Println("Serialized MeshMembAck: ", string(payload))
@@ -0,0 +1,59 @@
+package application
+
+import (
+	"testing"
+
+	paho "mqtt-fed/infra/queue"
+)
+
+// testMessage is a message received from a broker
+type testMessage struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m testMessage) Topic() string                { return m.topic }
+func (m testMessage) Payload() []byte              { return m.payload }
+func (m testMessage) Qos() byte                    { return m.qos }
+func (m testMessage) Retained() bool               { return m.retained }
+func (m testMessage) Properties() *paho.Properties { return nil }
+
+func TestRetainFlagSurvives(t *testing.T) {
+	f := &Federator{Ctx: &FederatorContext{}}
+
+	for _, retained := range []bool{true, false} {
+		msg, err := f.Deserialize(testMessage{topic: "federated/sensors/temp", payload: []byte("22.5"), qos: 1, retained: retained})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != "FederatedPub" || msg.FederatedPub.Retain != retained {
+			t.Fatalf("federated pub %+v, want retain %v", msg.FederatedPub, retained)
+		}
+
+		// every hop receives the flag in the routed pub
+		routedPub := RoutedPub{PubId: PubId{OriginId: 1, Seqn: 3}, Retain: msg.FederatedPub.Retain, Payload: msg.FederatedPub.Payload}
+		topic, payload := routedPub.Serialize("sensors/temp")
+
+		routed, err := f.Deserialize(testMessage{topic: topic, payload: payload, qos: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if routed.Type != "RoutedPub" || routed.RoutedPub.Retain != retained {
+			t.Fatalf("routed pub %+v, want retain %v", routed.RoutedPub, retained)
+		}
+	}
+
+	// an empty retained publish clears the retained message, it must get through too
+	msg, err := f.Deserialize(testMessage{topic: "federated/sensors/temp", qos: 1, retained: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !msg.FederatedPub.Retain || len(msg.FederatedPub.Payload) != 0 {
+		t.Fatalf("retained clear %+v", msg.FederatedPub)
+	}
+}
@@ -0,0 +1,178 @@
+package application
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const DEFAULT_ORDER_WINDOW = 500 * time.Millisecond
+const DEFAULT_ORDER_BUFFER = 64
+const ORDER_TICK = 100 * time.Millisecond
+
+// streamKey identifies the publications of one origin on one concrete topic,
+// the sequence of a PubId is only monotonic inside a stream. A restarted
+// origin has a new epoch and so a new stream
+type streamKey struct {
+	Topic    string
+	OriginId int64
+	Epoch    int64
+}
+
+// streamOf returns the stream key of a routed pub
+func (t *TopicWorker) streamOf(routedPub RoutedPub) streamKey {
+	return streamKey{
+		Topic:    routedPub.deliveryTopic(t.Topic),
+		OriginId: routedPub.PubId.OriginId,
+		Epoch:    routedPub.PubId.Epoch,
+	}
+}
+
+// restarted checks if a stream belongs to an earlier start of the origin of another stream
+func (key streamKey) restarted(current streamKey) bool {
+	return key.Topic == current.Topic && key.OriginId == current.OriginId && key.Epoch < current.Epoch
+}
+
+// originStream keeps the next sequence expected from an origin
+// and the publications that arrived ahead of it
+type originStream struct {
+	Next     int
+	Buffered map[int]bufferedPub
+}
+
+type bufferedPub struct {
+	RoutedPub RoutedPub
+	Qos       byte
+	Since     time.Time
+}
+
+// deliverOrdered releases routed pubs to the local broker in origin sequence.
+// Pubs ahead of the expected sequence wait until the gap is filled, the
+// buffer is full or the oldest one waited longer than the order window,
+// then the gap is skipped. Pubs behind the expected sequence are dropped
+func (t *TopicWorker) deliverOrdered(routedPub RoutedPub, qos byte) {
+	policy := t.policy(routedPub.deliveryTopic(t.Topic))
+	key := t.streamOf(routedPub)
+
+	stream, ok := t.Streams[key]
+	if !ok {
+		// what is left from before the origin restarted is delivered as is
+		for previous, old := range t.Streams {
+			if previous.restarted(key) {
+				t.flushStream(previous, old)
+				delete(t.Streams, previous)
+			}
+		}
+
+		stream = &originStream{
+			Next:     routedPub.PubId.Seqn,
+			Buffered: make(map[int]bufferedPub),
+		}
+		t.Streams[key] = stream
+	}
+
+	seqn := routedPub.PubId.Seqn
+
+	if seqn < stream.Next {
+		// far behind means an origin without epoch restarted and its sequence began again
+		if stream.Next-seqn > policy.orderBuffer() {
+			fmt.Println("Origin", key.OriginId, "restarted on", key.Topic, "resetting order")
+			t.flushStream(key, stream)
+			stream.Next = seqn
+		} else {
+			fmt.Println("Late pub", routedPub.PubId, "dropped to keep the order")
+			t.Ctx.Metrics.Inc("ordering.dropped_late")
+			return
+		}
+	}
+
+	stream.Buffered[seqn] = bufferedPub{
+		RoutedPub: routedPub,
+		Qos:       qos,
+		Since:     time.Now(),
+	}
+
+	t.releaseStream(key, stream, false)
+
+	if len(stream.Buffered) > 0 {
+		t.scheduleOrderTick()
+	}
+}
+
+// releaseStream delivers every buffered pub that is next in sequence,
+// skipping gaps when the stream is over its size or time bound (or force)
+func (t *TopicWorker) releaseStream(key streamKey, stream *originStream, force bool) {
+	policy := t.policy(key.Topic)
+
+	for len(stream.Buffered) > 0 {
+		if pending, ok := stream.Buffered[stream.Next]; ok {
+			delete(stream.Buffered, stream.Next)
+			stream.Next += 1
+			t.deliverLocal(pending.RoutedPub, pending.Qos)
+			continue
+		}
+
+		lowest := lowestSeqn(stream.Buffered)
+		oldest := stream.Buffered[lowest]
+
+		overflow := len(stream.Buffered) > policy.orderBuffer()
+		expired := time.Since(oldest.Since) > policy.orderWindow()
+
+		if !force && !overflow && !expired {
+			return
+		}
+
+		fmt.Println("Skipping gap", stream.Next, "to", lowest, "from origin", key.OriginId, "on", key.Topic)
+		t.Ctx.Metrics.Add("ordering.skipped", int64(lowest-stream.Next))
+		stream.Next = lowest
+	}
+}
+
+// flushStream delivers everything buffered in sequence, ignoring gaps
+func (t *TopicWorker) flushStream(key streamKey, stream *originStream) {
+	t.releaseStream(key, stream, true)
+}
+
+// handleOrderTick releases the streams whose gaps waited too long
+func (t *TopicWorker) handleOrderTick() {
+	t.OrderTimer = nil
+
+	buffered := false
+
+	for key, stream := range t.Streams {
+		t.releaseStream(key, stream, false)
+
+		if len(stream.Buffered) > 0 {
+			buffered = true
+		}
+	}
+
+	if buffered {
+		t.scheduleOrderTick()
+	}
+}
+
+// scheduleOrderTick makes sure an order tick is coming through the worker channel
+func (t *TopicWorker) scheduleOrderTick() {
+	if t.OrderTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+
+	t.OrderTimer = time.AfterFunc(ORDER_TICK, func() {
+		channel <- Message{Type: "OrderTick", Topic: topic}
+	})
+}
+
+func lowestSeqn(buffered map[int]bufferedPub) int {
+	seqns := make([]int, 0, len(buffered))
+	for seqn := range buffered {
+		seqns = append(seqns, seqn)
+	}
+
+	sort.Ints(seqns)
+
+	return seqns[0]
+}
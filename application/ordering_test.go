@@ -0,0 +1,69 @@
+package application
+
+import (
+	"testing"
+	"time"
+
+	paho "mqtt-fed/infra/queue"
+)
+
+// expiredPub is a routed pub that deliverLocal drops as expired, so the
+// releases can be counted in the metrics without a host broker
+func expiredPub(seqn int) RoutedPub {
+	expiry := uint32(1)
+
+	return RoutedPub{
+		Topic:      "sensors/temp",
+		PubId:      PubId{OriginId: 2, Seqn: seqn},
+		Timestamp:  time.Now().Add(-time.Hour).UnixNano(),
+		Properties: &paho.Properties{MessageExpiry: &expiry},
+	}
+}
+
+func TestReleaseStream(t *testing.T) {
+	tests := []struct {
+		name      string
+		next      int
+		buffered  []int
+		age       time.Duration
+		force     bool
+		delivered int64
+		skipped   int64
+		wantNext  int
+		wantLeft  int
+	}{
+		{"in sequence", 1, []int{1, 2, 3}, 0, false, 3, 0, 4, 0},
+		{"gap waits", 1, []int{3, 4}, 0, false, 0, 0, 1, 2},
+		{"release up to the gap", 1, []int{1, 3}, 0, false, 1, 0, 2, 1},
+		{"expired gap is skipped", 1, []int{3, 4}, time.Second, false, 2, 2, 5, 0},
+		{"forced gaps are skipped", 1, []int{2, 5}, 0, true, 2, 3, 6, 0},
+		{"full buffer skips the gap", 1, []int{3, 4, 5}, 0, false, 3, 2, 6, 0},
+	}
+
+	for _, test := range tests {
+		worker := newTestWorker("sensors/temp")
+		worker.Ctx.Policies = Policies{"sensors/temp": {Ordered: true, OrderBuffer: 2}}
+
+		stream := &originStream{Next: test.next, Buffered: make(map[int]bufferedPub)}
+		for _, seqn := range test.buffered {
+			stream.Buffered[seqn] = bufferedPub{RoutedPub: expiredPub(seqn), Since: time.Now().Add(-test.age)}
+		}
+
+		key := worker.streamOf(expiredPub(1))
+		worker.releaseStream(key, stream, test.force)
+
+		counters := worker.Ctx.Metrics.Snapshot().Counters
+
+		if counters["delivery.expired"] != test.delivered {
+			t.Errorf("%s: %d delivered, want %d", test.name, counters["delivery.expired"], test.delivered)
+		}
+
+		if counters["ordering.skipped"] != test.skipped {
+			t.Errorf("%s: %d skipped, want %d", test.name, counters["ordering.skipped"], test.skipped)
+		}
+
+		if stream.Next != test.wantNext || len(stream.Buffered) != test.wantLeft {
+			t.Errorf("%s: next %d with %d buffered, want %d with %d", test.name, stream.Next, len(stream.Buffered), test.wantNext, test.wantLeft)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TopicPolicy is a struct that
+// defines the delivery options of a
+// federated topic, every field is optional
+type TopicPolicy struct {
+	MaxQos         *byte         `json:"maxQos,omitempty"`         // Caps the publisher QoS on every hop and on local delivery
+	Reliable       bool          `json:"reliable,omitempty"`       // Hop by hop acks and retransmission of routed pubs
+	MaxRetransmits int           `json:"maxRetransmits,omitempty"` // Retransmissions before giving up on a neighbor
+	Ordered        bool          `json:"ordered,omitempty"`        // Deliver the pubs of each origin in sequence
+	OrderWindow    time.Duration `json:"orderWindow,omitempty"`    // How long a gap can hold back later pubs
+	OrderBuffer    int           `json:"orderBuffer,omitempty"`    // How many pubs per origin can wait for a gap
+	Repair         bool          `json:"repair,omitempty"`         // Detect sequence gaps and ask parents for the missing pubs
+	RateLimit      RateLimit     `json:"rateLimit,omitempty"`      // Local publications accepted per concrete topic
+	OriginLimit    RateLimit     `json:"originLimit,omitempty"`    // Routed publications accepted per origin federator
+	Compression    string        `json:"compression,omitempty"`    // Payload compression between federators, only "gzip" for now
+	CompressMin    int           `json:"compressMin,omitempty"`    // Smaller payloads are sent as is
+	CorePriority   *int          `json:"corePriority,omitempty"`   // Overrides the federator core priority on this topic
+}
+
+// Policies is a map of federated topic (or MQTT filter) to its policy
+type Policies map[string]TopicPolicy
+
+// Policy returns the policy of a federated topic, an exact entry wins,
+// otherwise the longest matching filter is used
+func (p Policies) Policy(topic string) TopicPolicy {
+	if policy, ok := p[topic]; ok {
+		return policy
+	}
+
+	var best string
+	var found bool
+
+	for filter := range p {
+		if IsFilter(filter) && MatchFilter(filter, topic) && (!found || len(filter) > len(best)) {
+			best = filter
+			found = true
+		}
+	}
+
+	if found {
+		return p[best]
+	}
+
+	return TopicPolicy{}
+}
+
+// CapQos lowers the QoS to the topic policy maximum
+func (p TopicPolicy) CapQos(qos byte) byte {
+	if p.MaxQos != nil && *p.MaxQos < qos {
+		return *p.MaxQos
+	}
+
+	return qos
+}
+
+// orderWindow returns the order window or its default
+func (p TopicPolicy) orderWindow() time.Duration {
+	if p.OrderWindow <= 0 {
+		return DEFAULT_ORDER_WINDOW
+	}
+
+	return p.OrderWindow
+}
+
+// orderBuffer returns the order buffer size or its default
+func (p TopicPolicy) orderBuffer() int {
+	if p.OrderBuffer <= 0 {
+		return DEFAULT_ORDER_BUFFER
+	}
+
+	return p.OrderBuffer
+}
+
+// loadPolicies merges the policies sent by the topology manager with the
+// ones in the TOPIC_POLICIES_FILE json file, the local file wins
+func loadPolicies(fromConfig Policies) Policies {
+	policies := make(Policies)
+
+	for topic, policy := range fromConfig {
+		policies[topic] = policy
+	}
+
+	path := os.Getenv("TOPIC_POLICIES_FILE")
+
+	if path == "" {
+		return policies
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		fmt.Println("Error reading topic policies file:", err)
+		return policies
+	}
+
+	var fromFile Policies
+
+	if err := json.Unmarshal(data, &fromFile); err != nil {
+		fmt.Println("Error parsing topic policies file:", err)
+		return policies
+	}
+
+	for topic, policy := range fromFile {
+		policies[topic] = policy
+	}
+
+	fmt.Println("Topic policies loaded: ", policies)
+
+	return policies
+}
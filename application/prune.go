@@ -0,0 +1,82 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+// hasActiveChildren checks if any child was refreshed recently
+func (t TopicWorker) hasActiveChildren() bool {
+	for id := range t.Children {
+		if t.isActiveChild(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leaveIfUnneeded tells the parents this federator no longer needs the
+// topic once it has no local subscribers and no children, so the branch
+// is pruned right away instead of expiring after three core ann intervals
+func (t *TopicWorker) leaveIfUnneeded() {
+	if t.hasLocalSub() || t.hasActiveChildren() {
+		return
+	}
+
+	core, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(CoreBroker)
+	if !ok || len(core.Parents) == 0 {
+		return
+	}
+
+	for i, parent := range core.Parents {
+		t.sendLeave(parent.Id, core.Id)
+
+		// a new beacon or child has to join again through the parents
+		t.CurrentCore.Other.Parents[i].WasAnswered = false
+	}
+
+	t.CurrentCore.Other.HasUnansweredParents = true
+	t.Children = make(map[int64]time.Time)
+
+	t.Ctx.Metrics.Inc("mesh.leaves_sent")
+}
+
+// sendLeave tells a parent this federator is no longer its child
+func (t *TopicWorker) sendLeave(parentId int64, coreId int64) {
+	if t.Ctx.neighbor(parentId) == nil {
+		return
+	}
+
+	leave := MeshMembLeave{
+		CoreId:   coreId,
+		SenderId: t.Ctx.id(),
+	}
+
+	topic, payload := leave.Serialize(t.Topic)
+
+	fmt.Println("Sending memb leave to parent", parentId, "On topic", topic)
+
+	if err := t.Ctx.neighbor(parentId).PublishAsync(topic, string(payload), 2, false); err != nil {
+		fmt.Println("error while send memb leave to", parentId)
+	}
+}
+
+// handleMembLeave removes a child that no longer needs the topic,
+// the prune goes on upstream when this federator is left without interest
+func (t *TopicWorker) handleMembLeave(leave MeshMembLeave) {
+	if leave.SenderId == t.Ctx.id() {
+		return
+	}
+
+	fmt.Println("Memb Leave ", t.Topic, " received: ", leave)
+
+	if _, ok := t.Children[leave.SenderId]; !ok {
+		return
+	}
+
+	delete(t.Children, leave.SenderId)
+	t.Ctx.Metrics.Inc("mesh.leaves_received")
+
+	t.leaveIfUnneeded()
+}
@@ -0,0 +1,225 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	paho "mqtt-fed/infra/queue"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const RATE_LIMIT_DROP = "drop"
+const RATE_LIMIT_DELAY = "delay"
+const DEFAULT_MAX_RATE_DELAY = time.Second
+
+// RateLimit is a struct that
+// defines a token bucket, Rate tokens are
+// added per second up to Burst, a zero Rate
+// means no limit
+type RateLimit struct {
+	Rate     float64       `json:"rate"`               // publications per second
+	Burst    int           `json:"burst,omitempty"`    // bucket size, defaults to one second of Rate
+	Action   string        `json:"action,omitempty"`   // "drop" (default) or "delay"
+	MaxDelay time.Duration `json:"maxDelay,omitempty"` // longest delay before dropping anyway
+}
+
+// tokenBucket keeps the tokens left of one limited key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a struct that
+// keeps the token buckets of the limited topics,
+// origins and neighbor links, it is shared by
+// every worker so it is safe for concurrent use
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiter creates a new RateLimiter instance
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// burst returns the bucket size or its default
+func (l RateLimit) burst() float64 {
+	if l.Burst <= 0 {
+		if l.Rate < 1 {
+			return 1
+		}
+		return l.Rate
+	}
+
+	return float64(l.Burst)
+}
+
+// maxDelay returns the max delay or its default
+func (l RateLimit) maxDelay() time.Duration {
+	if l.MaxDelay <= 0 {
+		return DEFAULT_MAX_RATE_DELAY
+	}
+
+	return l.MaxDelay
+}
+
+// Admit takes a token from the bucket of the key, returns how long the
+// caller must wait before sending and false if the publication must be
+// dropped, a delayed publication takes its token in advance
+func (r *RateLimiter) Admit(key string, limit RateLimit) (time.Duration, bool) {
+	return r.AdmitN(key, limit, 1)
+}
+
+// AdmitN is Admit for n publications sent as one message, a batch
+// larger than the bucket only has to wait for a full bucket
+func (r *RateLimiter) AdmitN(key string, limit RateLimit, n int) (time.Duration, bool) {
+	if r == nil || limit.Rate <= 0 {
+		return 0, true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.burst(), last: now}
+		r.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.Rate
+	bucket.last = now
+
+	if bucket.tokens > limit.burst() {
+		bucket.tokens = limit.burst()
+	}
+
+	needed := math.Min(float64(n), limit.burst())
+
+	if bucket.tokens >= needed {
+		bucket.tokens -= float64(n)
+		return 0, true
+	}
+
+	wait := time.Duration((needed - bucket.tokens) / limit.Rate * float64(time.Second))
+
+	if limit.Action == RATE_LIMIT_DELAY && wait <= limit.maxDelay() {
+		bucket.tokens -= float64(n)
+		return wait, true
+	}
+
+	return 0, false
+}
+
+// throttle applies a rate limit to a publication of the worker
+func (t *TopicWorker) throttle(kind string, key string, limit RateLimit) (time.Duration, bool) {
+	return t.Ctx.throttle(kind, key, limit)
+}
+
+// throttle applies a rate limit to a publication, kind names the limit
+// in the metrics. It returns how long a delayed publication must wait,
+// the caller hands it to delay, and false if the publication was dropped
+func (ctx *FederatorContext) throttle(kind string, key string, limit RateLimit) (time.Duration, bool) {
+	wait, ok := ctx.Limiter.Admit(kind+"/"+key, limit)
+
+	if !ok {
+		fmt.Println("Rate limit", kind, "exceeded for", key, ", dropping")
+		ctx.Metrics.Inc("ratelimit." + kind + ".dropped")
+		return 0, false
+	}
+
+	if wait > 0 {
+		ctx.Metrics.Inc("ratelimit." + kind + ".delayed")
+		ctx.Metrics.Observe("ratelimit."+kind+".delay", wait)
+	}
+
+	return wait, true
+}
+
+// throttleFederated applies the topic limit to a local publish before it is
+// given a sequence, a dropped publish must not leave a gap in the origin
+// stream that receivers would wait for or ask to repair. A sensor publishing
+// in a tight loop would be amplified to every mesh member. The host broker
+// does not tell which local client published, so the concrete topic is the
+// finest key a limit can use at the ingress
+func (f *Federator) throttleFederated(msg Message) {
+	wait, ok := f.Ctx.throttle("topic", msg.Topic, f.Ctx.policy(msg.Topic).RateLimit)
+
+	if !ok {
+		return
+	}
+
+	if wait > 0 {
+		time.AfterFunc(wait, func() {
+			f.federate(msg)
+		})
+		return
+	}
+
+	f.federate(msg)
+}
+
+// delay hands a message back to the worker once its wait is over,
+// the worker keeps handling every other message in the meantime.
+// Later publications of the same key wait longer, since their
+// tokens are taken in advance, so they stay in order
+func (t *TopicWorker) delay(wait time.Duration, msg Message) {
+	channel := t.Channel
+
+	time.AfterFunc(wait, func() {
+		channel <- msg
+	})
+}
+
+// linkGate returns the gate of the outbox of a neighbor link. It applies
+// the link limit to the routed pubs in the outbox itself, so new,
+// retransmitted, repaired, replayed and batched pubs all take a token, and
+// a delayed pub only holds back its own link. Control messages are never
+// limited, the mesh must keep working when the data is throttled
+func (ctx *FederatorContext) linkGate(id int64) paho.Gate {
+	key := "link/" + strconv.FormatInt(id, 10)
+
+	return func(topic string, payload []byte) (time.Duration, bool) {
+		count := routedPubCount(topic, payload)
+
+		if count == 0 {
+			return 0, true
+		}
+
+		wait, ok := ctx.Limiter.AdmitN(key, ctx.linkRateLimit(), count)
+
+		if !ok {
+			fmt.Println("Rate limit link exceeded for", id, ", dropping")
+			ctx.Metrics.Add("ratelimit.link.dropped", int64(count))
+		} else if wait > 0 {
+			ctx.Metrics.Add("ratelimit.link.delayed", int64(count))
+			ctx.Metrics.Observe("ratelimit.link.delay", wait)
+		}
+
+		return wait, ok
+	}
+}
+
+// routedPubCount returns how many routed pubs a message to a neighbor carries
+func routedPubCount(topic string, payload []byte) int {
+	if strings.HasPrefix(topic, ROUTING_TOPICS_LEVEL) {
+		return 1
+	}
+
+	if topic != BATCH_TOPIC {
+		return 0
+	}
+
+	var envelope struct{ Messages []struct{} }
+
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return 1
+	}
+
+	return len(envelope.Messages)
+}
@@ -0,0 +1,89 @@
+package application
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAdmit(t *testing.T) {
+	drop := RateLimit{Rate: 10, Burst: 2}
+	delay := RateLimit{Rate: 10, Burst: 2, Action: RATE_LIMIT_DELAY}
+	shortDelay := RateLimit{Rate: 1, Burst: 1, Action: RATE_LIMIT_DELAY, MaxDelay: 100 * time.Millisecond}
+
+	tests := []struct {
+		name  string
+		limit RateLimit
+		n     int
+		sent  int // admitted before, from a full bucket
+		ok    bool
+		wait  time.Duration
+	}{
+		{"no limit", RateLimit{}, 1, 100, true, 0},
+		{"within the burst", drop, 1, 1, true, 0},
+		{"over the burst is dropped", drop, 1, 2, false, 0},
+		{"over the burst is delayed", delay, 1, 2, true, 100 * time.Millisecond},
+		{"delays add up", delay, 1, 3, true, 200 * time.Millisecond},
+		{"delay over the max is dropped", shortDelay, 1, 1, false, 0},
+		{"batch larger than the burst", drop, 5, 0, true, 0},
+		{"batch waits for a full bucket", delay, 5, 1, true, 100 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		limiter := NewRateLimiter()
+
+		for i := 0; i < test.sent; i++ {
+			limiter.Admit("topic/sensors", test.limit)
+		}
+
+		wait, ok := limiter.AdmitN("topic/sensors", test.limit, test.n)
+
+		if ok != test.ok {
+			t.Errorf("%s: admitted %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+
+		// the bucket refills a little while the test runs
+		if wait > test.wait || wait < test.wait-10*time.Millisecond {
+			t.Errorf("%s: wait %s, want %s", test.name, wait, test.wait)
+		}
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	limiter := NewRateLimiter()
+	limit := RateLimit{Rate: 1, Burst: 1}
+
+	if _, ok := limiter.Admit("topic/a", limit); !ok {
+		t.Fatal("first pub of a dropped")
+	}
+
+	if _, ok := limiter.Admit("topic/b", limit); !ok {
+		t.Fatal("a key took the tokens of another")
+	}
+
+	if _, ok := limiter.Admit("topic/a", limit); ok {
+		t.Fatal("second pub of a admitted")
+	}
+}
+
+func TestRateLimitDefaults(t *testing.T) {
+	tests := []struct {
+		limit    RateLimit
+		burst    float64
+		maxDelay time.Duration
+	}{
+		{RateLimit{Rate: 5}, 5, DEFAULT_MAX_RATE_DELAY},
+		{RateLimit{Rate: 0.5}, 1, DEFAULT_MAX_RATE_DELAY},
+		{RateLimit{Rate: 5, Burst: 20, MaxDelay: time.Minute}, 20, time.Minute},
+	}
+
+	for _, test := range tests {
+		if burst := test.limit.burst(); burst != test.burst {
+			t.Errorf("%+v: burst %v, want %v", test.limit, burst, test.burst)
+		}
+
+		if maxDelay := test.limit.maxDelay(); maxDelay != test.maxDelay {
+			t.Errorf("%+v: max delay %s, want %s", test.limit, maxDelay, test.maxDelay)
+		}
+	}
+}
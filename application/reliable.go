@@ -0,0 +1,196 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+const RETRANSMIT_TICK = 250 * time.Millisecond
+const DEFAULT_RETRANSMIT_TIMEOUT = time.Second
+const MAX_RETRANSMIT_TIMEOUT = 30 * time.Second
+const DEFAULT_MAX_RETRANSMITS = 5
+
+// pendingKey identifies a routed pub waiting for the ack of one neighbor
+type pendingKey struct {
+	NeighborId int64
+	Pub        TopicPubId
+}
+
+// pendingPub is a routed pub sent in reliable mode
+// that was not acknowledged yet
+type pendingPub struct {
+	RoutedPub RoutedPub
+	Attempts  int
+	Timeout   time.Duration
+	NextRetry time.Time
+}
+
+// expectAcks starts tracking a reliable routed pub sent to the neighbors
+func (t *TopicWorker) expectAcks(routedPub RoutedPub, ids []int64) {
+	if !routedPub.Reliable {
+		return
+	}
+
+	timeout := DEFAULT_RETRANSMIT_TIMEOUT
+
+	for _, id := range ids {
+		t.Pending[pendingKey{NeighborId: id, Pub: routedPub.key(t.Topic)}] = &pendingPub{
+			RoutedPub: routedPub,
+			Timeout:   timeout,
+			NextRetry: time.Now().Add(timeout),
+		}
+	}
+
+	t.scheduleRetransmit()
+}
+
+// ackRoutedPub acknowledges a reliable routed pub to the neighbor that sent it,
+// duplicates are acknowledged too because the first ack may have been lost
+func (t *TopicWorker) ackRoutedPub(routedPub RoutedPub) {
+	if !routedPub.Reliable || t.Ctx.neighbor(routedPub.SenderId) == nil {
+		return
+	}
+
+	ack := RoutedPubAck{
+		PubId:    routedPub.PubId,
+		Topic:    routedPub.Topic,
+		SenderId: t.Ctx.id(),
+	}
+
+	topic, payload := ack.Serialize(t.Topic)
+
+	err := t.Ctx.neighbor(routedPub.SenderId).PublishAsync(topic, string(payload), 1, false)
+
+	if err != nil {
+		fmt.Println("error while send routed pub ack to", routedPub.SenderId)
+	}
+}
+
+// handleRoutedPubAck stops the retransmission of an acknowledged routed pub
+func (t *TopicWorker) handleRoutedPubAck(ack RoutedPubAck) {
+	routedPub := RoutedPub{PubId: ack.PubId, Topic: ack.Topic}
+	key := pendingKey{NeighborId: ack.SenderId, Pub: routedPub.key(t.Topic)}
+
+	if _, ok := t.Pending[key]; ok {
+		delete(t.Pending, key)
+		t.Ctx.Metrics.Inc("reliable.acked")
+	}
+}
+
+// handleRetransmitTick retransmits the routed pubs whose ack is overdue,
+// with exponential backoff, and gives up after the policy limit
+func (t *TopicWorker) handleRetransmitTick() {
+	t.RetransmitTimer = nil
+
+	now := time.Now()
+
+	for key, pending := range t.Pending {
+		if now.Before(pending.NextRetry) {
+			continue
+		}
+
+		maxRetransmits := t.policy(key.Pub.Topic).MaxRetransmits
+		if maxRetransmits <= 0 {
+			maxRetransmits = DEFAULT_MAX_RETRANSMITS
+		}
+
+		if pending.Attempts >= maxRetransmits {
+			fmt.Println("Giving up on", key.Pub, "to", key.NeighborId, "after", pending.Attempts, "retransmissions")
+			t.Ctx.Metrics.Inc("reliable.give_ups")
+			delete(t.Pending, key)
+			continue
+		}
+
+		pending.Attempts += 1
+		pending.Timeout *= 2
+		if pending.Timeout > MAX_RETRANSMIT_TIMEOUT {
+			pending.Timeout = MAX_RETRANSMIT_TIMEOUT
+		}
+		pending.NextRetry = now.Add(pending.Timeout)
+
+		target := key.NeighborId
+
+		// the mesh may have changed since the pub was sent, a neighbor
+		// that is no longer a parent or child is replaced by a current one
+		if !t.isMeshNeighbor(target) {
+			delete(t.Pending, key)
+
+			alternate, ok := t.alternateNeighbor(pending.RoutedPub)
+			if !ok {
+				t.Ctx.Metrics.Inc("reliable.give_ups")
+				continue
+			}
+
+			target = alternate
+			t.Pending[pendingKey{NeighborId: target, Pub: key.Pub}] = pending
+		}
+
+		routedPub := pending.RoutedPub
+		routedPub.SenderId = t.Ctx.id()
+
+		qos := t.policy(key.Pub.Topic).CapQos(routedPub.Qos)
+
+		fmt.Println("Retransmitting", key.Pub, "to", target, "attempt", pending.Attempts)
+		t.Ctx.Metrics.Inc("reliable.retransmits")
+		t.sendRoutedPub(routedPub, qos, []int64{target})
+	}
+
+	if len(t.Pending) > 0 {
+		t.scheduleRetransmit()
+	}
+}
+
+// scheduleRetransmit makes sure a retransmit tick is coming,
+// the tick goes through the worker channel so the pending
+// map is only touched by the worker goroutine
+func (t *TopicWorker) scheduleRetransmit() {
+	if t.RetransmitTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+
+	t.RetransmitTimer = time.AfterFunc(RETRANSMIT_TICK, func() {
+		channel <- Message{Type: "RetransmitTick", Topic: topic}
+	})
+}
+
+// isMeshNeighbor checks if the neighbor is a current parent or active child
+func (t TopicWorker) isMeshNeighbor(id int64) bool {
+	for _, parent := range t.CurrentCore.Other.Parents {
+		if parent.Id == id {
+			return true
+		}
+	}
+
+	return t.isActiveChild(id)
+}
+
+// alternateNeighbor picks a current parent or child that is not
+// already waiting for the ack of the same routed pub
+func (t TopicWorker) alternateNeighbor(routedPub RoutedPub) (int64, bool) {
+	var candidates []int64
+
+	for _, parent := range t.CurrentCore.Other.Parents {
+		candidates = append(candidates, parent.Id)
+	}
+
+	for id := range t.Children {
+		if t.isActiveChild(id) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	for _, id := range candidates {
+		if id == routedPub.PubId.OriginId {
+			continue
+		}
+
+		if _, ok := t.Pending[pendingKey{NeighborId: id, Pub: routedPub.key(t.Topic)}]; !ok {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
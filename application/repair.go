@@ -0,0 +1,223 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+const REPAIR_BUFFER_SIZE = 256
+const NACK_DELAY = 100 * time.Millisecond
+const MAX_NACKS = 3
+const MAX_MISSING_PER_GAP = 64
+
+// gapStream keeps the highest sequence received from an origin
+// on a concrete topic and the sequences still missing below it
+type gapStream struct {
+	Highest int
+	Missing map[int]*missingPub
+}
+
+// missingPub is a sequence that was skipped by the origin stream
+type missingPub struct {
+	Attempts int
+	NextNack time.Time
+	From     int64 // neighbor that delivered the pub revealing the gap
+}
+
+// keepForRepair stores a routed pub in the repair buffer so it
+// can be retransmitted when a child reports it as missing, a pub
+// without hops left would be dropped by the child and is not kept
+func (t *TopicWorker) keepForRepair(routedPub RoutedPub) {
+	if routedPub.TTL <= 0 {
+		return
+	}
+
+	t.RepairBuffer.Add(routedPub.key(t.Topic), routedPub)
+}
+
+// trackGaps checks the sequence of a received routed pub against the
+// highest one of its origin stream and records the skipped sequences
+func (t *TopicWorker) trackGaps(routedPub RoutedPub, senderId int64) {
+	if !t.policy(routedPub.deliveryTopic(t.Topic)).Repair {
+		return
+	}
+
+	key := t.streamOf(routedPub)
+	seqn := routedPub.PubId.Seqn
+
+	stream, ok := t.Gaps[key]
+	if !ok {
+		// the pubs missing from before the origin restarted are not asked for anymore
+		for previous := range t.Gaps {
+			if previous.restarted(key) {
+				delete(t.Gaps, previous)
+			}
+		}
+
+		t.Gaps[key] = &gapStream{
+			Highest: seqn,
+			Missing: make(map[int]*missingPub),
+		}
+		return
+	}
+
+	if seqn <= stream.Highest {
+		// far behind means an origin without epoch restarted and its sequence began again
+		if stream.Highest-seqn > REPAIR_BUFFER_SIZE {
+			stream.Highest = seqn
+			stream.Missing = make(map[int]*missingPub)
+		} else if _, ok := stream.Missing[seqn]; ok {
+			delete(stream.Missing, seqn)
+			t.Ctx.Metrics.Inc("repair.filled")
+		}
+		return
+	}
+
+	first := stream.Highest + 1
+	if seqn-first > MAX_MISSING_PER_GAP {
+		first = seqn - MAX_MISSING_PER_GAP
+	}
+
+	for missing := first; missing < seqn; missing++ {
+		stream.Missing[missing] = &missingPub{
+			NextNack: time.Now().Add(NACK_DELAY),
+			From:     senderId,
+		}
+	}
+
+	if seqn > first {
+		fmt.Println("Gap detected on", key.Topic, "from origin", key.OriginId, ":", first, "to", seqn-1)
+		t.Ctx.Metrics.Add("repair.gaps", int64(seqn-first))
+		t.scheduleRepairTick()
+	}
+
+	stream.Highest = seqn
+}
+
+// handleRepairTick sends NACKs for the sequences that are still missing,
+// each retry goes to another parent, and gives up after MAX_NACKS
+func (t *TopicWorker) handleRepairTick() {
+	t.RepairTimer = nil
+
+	now := time.Now()
+	waiting := false
+
+	for key, stream := range t.Gaps {
+		nacks := make(map[int64][]int)
+
+		for seqn, missing := range stream.Missing {
+			if now.Before(missing.NextNack) {
+				waiting = true
+				continue
+			}
+
+			if missing.Attempts >= MAX_NACKS {
+				fmt.Println("Giving up on", seqn, "from origin", key.OriginId, "on", key.Topic)
+				t.Ctx.Metrics.Inc("repair.gave_up")
+				delete(stream.Missing, seqn)
+				continue
+			}
+
+			target := t.repairSource(missing)
+			missing.Attempts += 1
+			missing.NextNack = now.Add(NACK_DELAY << uint(missing.Attempts))
+			waiting = true
+
+			nacks[target] = append(nacks[target], seqn)
+		}
+
+		for target, seqns := range nacks {
+			t.sendNack(target, key, seqns)
+		}
+	}
+
+	if waiting {
+		t.scheduleRepairTick()
+	}
+}
+
+// repairSource picks who is asked for a missing pub: the neighbor that
+// revealed the gap first, then the parents in turn
+func (t TopicWorker) repairSource(missing *missingPub) int64 {
+	parents := t.CurrentCore.Other.Parents
+
+	if missing.Attempts == 0 || len(parents) == 0 {
+		return missing.From
+	}
+
+	return parents[(missing.Attempts-1)%len(parents)].Id
+}
+
+// sendNack asks a neighbor to retransmit the missing sequences of a stream
+func (t *TopicWorker) sendNack(target int64, key streamKey, seqns []int) {
+	if t.Ctx.neighbor(target) == nil {
+		return
+	}
+
+	nack := MeshNack{
+		SenderId: t.Ctx.id(),
+		OriginId: key.OriginId,
+		Epoch:    key.Epoch,
+		Seqns:    seqns,
+	}
+
+	if key.Topic != t.Topic {
+		nack.Topic = key.Topic
+	}
+
+	topic, payload := nack.Serialize(t.Topic)
+
+	fmt.Println("Sending nack for", seqns, "to", target)
+	t.Ctx.Metrics.Inc("repair.nacks_sent")
+
+	err := t.Ctx.neighbor(target).PublishAsync(topic, string(payload), 1, false)
+
+	if err != nil {
+		fmt.Println("error while send nack to", target)
+	}
+}
+
+// handleNack retransmits the requested pubs found in the repair buffer
+func (t *TopicWorker) handleNack(nack MeshNack) {
+	if nack.SenderId == t.Ctx.id() {
+		return
+	}
+
+	fmt.Println("Nack ", t.Topic, " received: ", nack)
+
+	for _, seqn := range nack.Seqns {
+		request := RoutedPub{
+			PubId: PubId{OriginId: nack.OriginId, Epoch: nack.Epoch, Seqn: seqn},
+			Topic: nack.Topic,
+		}
+
+		value, ok := t.RepairBuffer.Get(request.key(t.Topic))
+
+		if !ok {
+			t.Ctx.Metrics.Inc("repair.not_buffered")
+			continue
+		}
+
+		routedPub := value.(RoutedPub)
+		routedPub.SenderId = t.Ctx.id()
+
+		qos := t.policy(routedPub.deliveryTopic(t.Topic)).CapQos(routedPub.Qos)
+
+		t.Ctx.Metrics.Inc("repair.retransmitted")
+		t.sendRoutedPub(routedPub, qos, []int64{nack.SenderId})
+	}
+}
+
+// scheduleRepairTick makes sure a repair tick is coming through the worker channel
+func (t *TopicWorker) scheduleRepairTick() {
+	if t.RepairTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+
+	t.RepairTimer = time.AfterFunc(NACK_DELAY, func() {
+		channel <- Message{Type: "RepairTick", Topic: topic}
+	})
+}
@@ -0,0 +1,89 @@
+package application
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestTrackGaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		received []PubId
+		highest  int
+		missing  []int
+	}{
+		{"in sequence", []PubId{{Seqn: 1}, {Seqn: 2}, {Seqn: 3}}, 3, nil},
+		{"gap", []PubId{{Seqn: 1}, {Seqn: 4}}, 4, []int{2, 3}},
+		{"gap filled", []PubId{{Seqn: 1}, {Seqn: 4}, {Seqn: 2}}, 4, []int{3}},
+		{"duplicate", []PubId{{Seqn: 1}, {Seqn: 2}, {Seqn: 2}}, 2, nil},
+		{"gap is bounded", []PubId{{Seqn: 1}, {Seqn: 100}}, 100, seqnsFrom(100-MAX_MISSING_PER_GAP, 99)},
+		{"restart without epoch", []PubId{{Seqn: 500}, {Seqn: 502}, {Seqn: 1}}, 1, nil},
+		{"restart with a new epoch", []PubId{{Epoch: 1, Seqn: 5}, {Epoch: 1, Seqn: 7}, {Epoch: 2, Seqn: 1}}, 1, nil},
+	}
+
+	for _, test := range tests {
+		worker := newTestWorker("sensors/temp")
+		worker.Ctx.Policies = Policies{"sensors/temp": {Repair: true}}
+
+		var last RoutedPub
+		for _, pubId := range test.received {
+			pubId.OriginId = 2
+			last = RoutedPub{Topic: "sensors/temp", PubId: pubId}
+			worker.trackGaps(last, 3)
+		}
+
+		if worker.RepairTimer != nil {
+			worker.RepairTimer.Stop()
+		}
+
+		if len(worker.Gaps) != 1 {
+			t.Errorf("%s: %d streams, want 1", test.name, len(worker.Gaps))
+			continue
+		}
+
+		stream := worker.Gaps[worker.streamOf(last)]
+
+		var missing []int
+		for seqn := range stream.Missing {
+			missing = append(missing, seqn)
+		}
+		sort.Ints(missing)
+
+		if stream.Highest != test.highest || !equalSeqns(missing, test.missing) {
+			t.Errorf("%s: highest %d missing %v, want %d missing %v", test.name, stream.Highest, missing, test.highest, test.missing)
+		}
+	}
+}
+
+func TestTrackGapsNeedsRepair(t *testing.T) {
+	worker := newTestWorker("sensors/temp")
+
+	worker.trackGaps(RoutedPub{Topic: "sensors/temp", PubId: PubId{OriginId: 2, Seqn: 1}}, 3)
+
+	if len(worker.Gaps) != 0 {
+		t.Fatalf("%d streams tracked without repair, want 0", len(worker.Gaps))
+	}
+}
+
+func seqnsFrom(first int, last int) []int {
+	var seqns []int
+	for seqn := first; seqn <= last; seqn++ {
+		seqns = append(seqns, seqn)
+	}
+
+	return seqns
+}
+
+func equalSeqns(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,126 @@
+package application
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	paho "mqtt-fed/infra/queue"
+	"time"
+)
+
+// DEFAULT_REPLAY_WINDOW is used when the config does not set one
+const DEFAULT_REPLAY_WINDOW = 30 * time.Second
+
+// ReplayWindow is a struct that
+// keeps the secure publications already
+// delivered by each origin, anything older
+// than the window or seen twice is rejected
+type ReplayWindow struct {
+	Window    time.Duration
+	origins   map[int64]map[replayKey]time.Time
+	lastPrune time.Time
+}
+
+// replayKey identifies a publication of an origin, the timestamp
+// is part of it because the sequence restarts with the origin
+type replayKey struct {
+	Seqn      int
+	Timestamp int64
+}
+
+// NewReplayWindow creates a new ReplayWindow instance
+func NewReplayWindow(window time.Duration) *ReplayWindow {
+	if window <= 0 {
+		window = DEFAULT_REPLAY_WINDOW
+	}
+
+	return &ReplayWindow{
+		Window:    window,
+		origins:   make(map[int64]map[replayKey]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// Accept checks an authenticated origin timestamp and sequence and
+// records it, returns false if the publication is stale, too far in
+// the future or was already accepted
+func (r *ReplayWindow) Accept(originId int64, seqn int, timestamp int64) bool {
+	now := time.Now()
+	sent := time.Unix(0, timestamp)
+
+	if now.Sub(sent) > r.Window || sent.Sub(now) > r.Window {
+		return false
+	}
+
+	r.prune(now)
+
+	seen, ok := r.origins[originId]
+	if !ok {
+		seen = make(map[replayKey]time.Time)
+		r.origins[originId] = seen
+	}
+
+	key := replayKey{Seqn: seqn, Timestamp: timestamp}
+
+	if _, ok := seen[key]; ok {
+		return false
+	}
+
+	seen[key] = sent
+
+	return true
+}
+
+// prune forgets publications that are already out of the window,
+// it runs at most once per window to keep Accept cheap
+func (r *ReplayWindow) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < r.Window {
+		return
+	}
+
+	r.lastPrune = now
+
+	for originId, seen := range r.origins {
+		for key, sent := range seen {
+			if now.Sub(sent) > r.Window {
+				delete(seen, key)
+			}
+		}
+
+		if len(seen) == 0 {
+			delete(r.origins, originId)
+		}
+	}
+}
+
+// secureMacInput builds the authenticated data of a secure publication,
+// the publication id, origin timestamp, topic, MQTT 5 properties and payload
+// encoding are covered together with the plaintext so none of them can be changed.
+// The epoch is only covered when set, federators that predate it do not send one
+func secureMacInput(topic string, pubId PubId, timestamp int64, props *paho.Properties, encoding string, payload []byte) []byte {
+	header := make([]byte, 24)
+	binary.BigEndian.PutUint64(header[0:8], uint64(pubId.OriginId))
+	binary.BigEndian.PutUint64(header[8:16], uint64(pubId.Seqn))
+	binary.BigEndian.PutUint64(header[16:24], uint64(timestamp))
+
+	if pubId.Epoch != 0 {
+		epoch := make([]byte, 8)
+		binary.BigEndian.PutUint64(epoch, uint64(pubId.Epoch))
+		header = append(header, epoch...)
+	}
+
+	input := append(header, byte(len(topic)>>8), byte(len(topic)))
+	input = append(input, topic...)
+
+	if !props.IsEmpty() {
+		encoded, _ := json.Marshal(props)
+		input = append(input, byte(len(encoded)>>8), byte(len(encoded)))
+		input = append(input, encoded...)
+	} else {
+		input = append(input, 0, 0)
+	}
+
+	input = append(input, byte(len(encoding)))
+	input = append(input, encoding...)
+
+	return append(input, payload...)
+}
@@ -0,0 +1,52 @@
+package application
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayWindowAccept(t *testing.T) {
+	now := time.Now().UnixNano()
+
+	tests := []struct {
+		name      string
+		originId  int64
+		seqn      int
+		timestamp int64
+		want      bool
+	}{
+		{"fresh", 2, 1, now, true},
+		{"seen twice", 2, 1, now, false},
+		{"next seqn", 2, 2, now, true},
+		{"same seqn of another origin", 3, 1, now, true},
+		{"same seqn after a restart", 2, 1, now + 1, true},
+		{"stale", 2, 3, now - int64(time.Minute), false},
+		{"too far in the future", 2, 4, now + int64(time.Minute), false},
+	}
+
+	window := NewReplayWindow(30 * time.Second)
+
+	for _, test := range tests {
+		if got := window.Accept(test.originId, test.seqn, test.timestamp); got != test.want {
+			t.Errorf("%s: Accept = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReplayWindowPrune(t *testing.T) {
+	window := NewReplayWindow(time.Second)
+	sent := time.Now().Add(-900 * time.Millisecond).UnixNano()
+
+	window.Accept(2, 1, sent)
+	window.prune(time.Now().Add(2 * time.Second))
+
+	if len(window.origins) != 0 {
+		t.Fatalf("%d origins kept after the window, want 0", len(window.origins))
+	}
+}
+
+func TestNewReplayWindowDefault(t *testing.T) {
+	if window := NewReplayWindow(0); window.Window != DEFAULT_REPLAY_WINDOW {
+		t.Fatalf("window %s, want %s", window.Window, DEFAULT_REPLAY_WINDOW)
+	}
+}
@@ -0,0 +1,113 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduleBeaconCheck makes sure a beacon tick comes through the
+// worker channel when the latest beacon expires
+func (t *TopicWorker) scheduleBeaconCheck() {
+	if t.BeaconTimer != nil {
+		return
+	}
+
+	channel := t.Channel
+	topic := t.Topic
+	expiry := time.Until(t.LatestBeacon.Add(3 * t.Ctx.beaconInterval()))
+
+	t.BeaconTimer = time.AfterFunc(expiry, func() {
+		channel <- Message{Type: "BeaconTick", Topic: topic}
+	})
+}
+
+// handleBeaconTick resigns as core once the local
+// subscribers stopped sending beacons
+func (t *TopicWorker) handleBeaconTick() {
+	t.BeaconTimer = nil
+
+	if t.hasLocalSub() {
+		t.scheduleBeaconCheck()
+		return
+	}
+
+	fmt.Println("Beacons expired for", t.Topic)
+
+	t.resign()
+	t.leaveIfUnneeded()
+}
+
+// resign stops announcing this federator as core, the retained core anns
+// left on the neighbors are cleared and a withdrawal tells the members
+// to elect a new core right away instead of waiting for the core to expire
+func (t *TopicWorker) resign() {
+	announcer, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(Announcer)
+	if !ok {
+		return
+	}
+
+	announcer.Drop()
+
+	t.CurrentCore = Core{}
+	t.Children = make(map[int64]time.Time)
+
+	withdrawal := CoreWithdrawal{
+		CoreId:   t.Ctx.id(),
+		SenderId: t.Ctx.id(),
+	}
+
+	topic, payload := withdrawal.Serialize(t.Topic)
+	coreAnnTopic := CORE_ANN_TOPIC_LEVEL + EscapeTopic(t.Topic)
+
+	for id, neighbor := range t.Ctx.neighbors() {
+		// an empty retained message clears the last core ann kept by the broker
+		if err := neighbor.PublishAsync(coreAnnTopic, "", 2, true); err != nil {
+			fmt.Println("error while clearing core ann on", id)
+		}
+
+		if err := neighbor.PublishAsync(topic, string(payload), 2, false); err != nil {
+			fmt.Println("error while send core withdrawal to", id)
+		}
+	}
+
+	fmt.Println(t.Ctx.id(), "resigned as core of", t.Topic)
+	t.Ctx.Metrics.Inc("core.resignations")
+}
+
+// handleCoreWithdrawal forgets a core that resigned and forwards the
+// withdrawal, a member with local subscribers starts announcing itself
+// so the election of the new core does not wait for the next beacon
+func (t *TopicWorker) handleCoreWithdrawal(withdrawal CoreWithdrawal) {
+	if withdrawal.CoreId == t.Ctx.id() || withdrawal.SenderId == t.Ctx.id() {
+		return
+	}
+
+	fmt.Println("Core Withdrawal ", t.Topic, " received: ", withdrawal)
+
+	// only the members following the core forward it, so the flood ends
+	core, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(CoreBroker)
+	if !ok || core.Id != withdrawal.CoreId {
+		return
+	}
+
+	t.CurrentCore = Core{}
+	t.Children = make(map[int64]time.Time)
+	t.Ctx.Metrics.Inc("core.withdrawals")
+
+	senderId := withdrawal.SenderId
+	withdrawal.SenderId = t.Ctx.id()
+
+	topic, payload := withdrawal.Serialize(t.Topic)
+
+	for id, neighbor := range t.Ctx.neighbors() {
+		if id != senderId {
+			if err := neighbor.PublishAsync(topic, string(payload), 2, false); err != nil {
+				fmt.Println("error while forward core withdrawal to", id)
+			}
+		}
+	}
+
+	if t.hasLocalSub() {
+		t.handleBeacon()
+	}
+}
@@ -0,0 +1,64 @@
+package application
+
+import (
+	"fmt"
+	"time"
+)
+
+// keepRetained stores the last retained publication of a concrete topic
+// so it can be sent to brokers that join the mesh later, a retained pub
+// with an empty payload clears it, just like on an MQTT broker. The retain
+// flag of local publishes is only known on MQTT 5 host links, on MQTT 3
+// the broker clears it and nothing is kept by the origin federator
+func (t *TopicWorker) keepRetained(routedPub RoutedPub) {
+	if !routedPub.Retain {
+		return
+	}
+
+	topic := routedPub.deliveryTopic(t.Topic)
+
+	if len(routedPub.Payload) == 0 {
+		fmt.Println("Retained pub cleared on", topic)
+		t.Retained.Remove(topic)
+		return
+	}
+
+	// without hops left it cannot be replayed, but it still replaces the old one
+	if routedPub.TTL <= 0 {
+		t.Retained.Remove(topic)
+		return
+	}
+
+	t.Retained.Add(topic, routedPub)
+}
+
+// sendRetained sends every retained publication kept by this worker to a
+// child that was just admitted to the mesh. Secure publications are not
+// kept because the receivers replay window would reject them anyway
+func (t *TopicWorker) sendRetained(childId int64) {
+	for _, key := range t.Retained.Keys() {
+		value, ok := t.Retained.Peek(key)
+
+		if !ok {
+			continue
+		}
+
+		routedPub := value.(RoutedPub)
+		routedPub.SenderId = t.Ctx.id()
+
+		qos := t.policy(routedPub.deliveryTopic(t.Topic)).CapQos(routedPub.Qos)
+
+		fmt.Println("Sending retained pub on", key, "to new child", childId)
+		t.sendRoutedPub(routedPub, qos, []int64{childId})
+
+		// on a reliable topic the replay is retransmitted like any other pub
+		t.expectAcks(routedPub, []int64{childId})
+	}
+}
+
+// isActiveChild checks if the neighbor is a child that was refreshed recently
+func (t TopicWorker) isActiveChild(id int64) bool {
+	lastHeard, ok := t.Children[id]
+
+	return ok && time.Since(lastHeard) < 3*t.Ctx.coreAnnInterval()
+}
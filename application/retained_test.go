@@ -0,0 +1,55 @@
+package application
+
+import (
+	"testing"
+
+	"mqtt-fed/infra/metrics"
+)
+
+func newTestWorker(topic string) *TopicWorker {
+	ctx := &FederatorContext{
+		Id:        1,
+		CacheSize: 16,
+		Metrics:   metrics.NewRegistry(),
+	}
+
+	return NewTopicWorker(topic, ctx, make(chan Message, 16))
+}
+
+func TestKeepRetained(t *testing.T) {
+	worker := newTestWorker("sensors/#")
+
+	retained := func(topic string, payload string, ttl int) RoutedPub {
+		return RoutedPub{Topic: topic, Retain: true, TTL: ttl, Payload: []byte(payload)}
+	}
+
+	worker.keepRetained(retained("sensors/temp", "22.5", 4))
+	worker.keepRetained(retained("sensors/hum", "40", 4))
+	worker.keepRetained(RoutedPub{Topic: "sensors/wind", TTL: 4, Payload: []byte("3")})
+
+	if worker.Retained.Len() != 2 {
+		t.Fatalf("%d retained pubs, want 2", worker.Retained.Len())
+	}
+
+	// a newer retained pub replaces the kept one
+	worker.keepRetained(retained("sensors/temp", "23.0", 4))
+
+	value, _ := worker.Retained.Peek("sensors/temp")
+	if string(value.(RoutedPub).Payload) != "23.0" {
+		t.Fatalf("kept %q, want the latest retained pub", value.(RoutedPub).Payload)
+	}
+
+	// an empty payload clears it, like on an MQTT broker
+	worker.keepRetained(retained("sensors/temp", "", 4))
+
+	if worker.Retained.Contains("sensors/temp") {
+		t.Fatal("retained pub not cleared by an empty payload")
+	}
+
+	// without hops left it can not be replayed but still replaces the old one
+	worker.keepRetained(retained("sensors/hum", "41", 0))
+
+	if worker.Retained.Contains("sensors/hum") {
+		t.Fatal("stale retained pub kept after a newer one without hops left")
+	}
+}
@@ -0,0 +1,146 @@
+package application
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const TRACE_ROLE_CORE = "core"
+const TRACE_ROLE_PARENT = "parent"
+const TRACE_ROLE_CHILD = "child"
+const TRACE_ROLE_MEMBER = "member"
+
+// handleTraceRequest starts a trace of the mesh of the topic,
+// it is requested by a local client on the host broker
+func (t *TopicWorker) handleTraceRequest(request TraceRequest) {
+	if !strings.HasPrefix(request.ReplyTopic, TRACE_RESULT_LEVEL) {
+		fmt.Println("Trace reply topic must start with", TRACE_RESULT_LEVEL)
+		return
+	}
+
+	fmt.Println("Trace ", t.Topic, " requested: ", request.TraceId)
+
+	t.handleTrace(Trace{
+		TraceId:    request.TraceId,
+		ReplyTopic: request.ReplyTopic,
+		SenderId:   t.Ctx.id(),
+		TTL:        t.Ctx.hopLimit(),
+	})
+}
+
+// handleTrace adds this federator to the path of a trace, replies to the
+// requester and forwards the trace to the parents and children the same
+// way a routed pub is forwarded
+func (t *TopicWorker) handleTrace(trace Trace) {
+	key := "trace/" + trace.TraceId
+
+	if t.Cache.Contains(key) {
+		return
+	}
+
+	t.Cache.Add(key, true)
+
+	trace.Hops = append(trace.Hops, TraceHop{
+		FederatorId: t.Ctx.id(),
+		Role:        t.traceRole(trace),
+		LocalSub:    t.hasLocalSub(),
+		Timestamp:   time.Now().UnixNano(),
+	})
+
+	t.relayTraceReply(TraceReply{
+		TraceId:    trace.TraceId,
+		ReplyTopic: trace.ReplyTopic,
+		Hops:       trace.Hops,
+	})
+
+	trace.TTL -= 1
+	if trace.TTL <= 0 {
+		return
+	}
+
+	senderId := trace.SenderId
+	trace.SenderId = t.Ctx.id()
+
+	var ids []int64
+
+	for _, parent := range t.CurrentCore.Other.Parents {
+		if parent.Id != senderId {
+			ids = append(ids, parent.Id)
+		}
+	}
+
+	for id := range t.Children {
+		if id != senderId && t.isActiveChild(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	topic, payload := trace.Serialize(t.Topic)
+	SendTo(topic, payload, 1, ids, t.Ctx.neighbors())
+}
+
+// traceRole returns the role of this federator towards the previous hop
+func (t TopicWorker) traceRole(trace Trace) string {
+	if _, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(Announcer); ok {
+		return TRACE_ROLE_CORE
+	}
+
+	if len(trace.Hops) > 0 {
+		if _, ok := t.Children[trace.SenderId]; ok {
+			return TRACE_ROLE_PARENT
+		}
+
+		for _, parent := range t.CurrentCore.Other.Parents {
+			if parent.Id == trace.SenderId {
+				return TRACE_ROLE_CHILD
+			}
+		}
+	}
+
+	return TRACE_ROLE_MEMBER
+}
+
+// relayTraceReply sends a trace reply one hop back along its path,
+// the first federator of the path publishes it to the requester
+func (t *TopicWorker) relayTraceReply(reply TraceReply) {
+	index := -1
+	for i, hop := range reply.Hops {
+		if hop.FederatorId == t.Ctx.id() {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return
+	}
+
+	if index == 0 {
+		if !strings.HasPrefix(reply.ReplyTopic, TRACE_RESULT_LEVEL) {
+			return
+		}
+
+		payload, _ := reply.Payload()
+
+		_, err := t.Ctx.hostClient().Publish(reply.ReplyTopic, string(payload), 1, false)
+		if err != nil {
+			fmt.Println("Error while send trace reply to the requester ", err)
+		}
+
+		return
+	}
+
+	previous := reply.Hops[index-1].FederatorId
+
+	if t.Ctx.neighbor(previous) == nil {
+		fmt.Println("Trace reply can not be relayed,", previous, "is not a neighbor")
+		return
+	}
+
+	topic, payload := reply.Serialize(t.Topic)
+
+	if err := t.Ctx.neighbor(previous).PublishAsync(topic, string(payload), 1, false); err != nil {
+		fmt.Println("error while relay trace reply to", previous)
+	}
+}
@@ -0,0 +1,39 @@
+package application
+
+import "fmt"
+
+// DEFAULT_TTL is used when the network diameter is not configured
+const DEFAULT_TTL = 32
+
+// initialTTL derives the hop limit of the routed pubs from the network
+// diameter, doubled because a re-election can make the paths longer
+func initialTTL(diameter int) int {
+	if diameter <= 0 {
+		return DEFAULT_TTL
+	}
+
+	return 2 * diameter
+}
+
+// ttlExpired checks if a routed pub ran out of hops, the routing
+// loops stopped this way are counted in the metrics
+func (t *TopicWorker) ttlExpired(ttl int, pubId PubId) bool {
+	if ttl > 0 {
+		return false
+	}
+
+	fmt.Println("Hop limit reached for", pubId, "on", t.Topic, ", dropping")
+	t.Ctx.Metrics.Inc("routing.ttl_expired")
+
+	return true
+}
+
+// receivedTTL returns the hops left of a received pub, a federator that
+// predates the hop limit sends none and its pubs start with a full one
+func (t *TopicWorker) receivedTTL(ttl int) int {
+	if ttl == 0 {
+		return t.Ctx.hopLimit()
+	}
+
+	return ttl
+}
@@ -0,0 +1,59 @@
+package application
+
+import "testing"
+
+func TestInitialTTL(t *testing.T) {
+	tests := []struct {
+		diameter int
+		ttl      int
+	}{
+		{0, DEFAULT_TTL},
+		{-1, DEFAULT_TTL},
+		{1, 2},
+		{6, 12},
+	}
+
+	for _, test := range tests {
+		if ttl := initialTTL(test.diameter); ttl != test.ttl {
+			t.Errorf("initialTTL(%d) = %d, want %d", test.diameter, ttl, test.ttl)
+		}
+	}
+}
+
+func TestReceivedTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		received int
+		ttl      int
+	}{
+		{"no hop limit sent", 0, 12},
+		{"hops left", 5, 5},
+		{"last hop", 1, 1},
+		{"out of hops", -1, -1},
+	}
+
+	worker := newTestWorker("sensors/temp")
+	worker.Ctx.InitialTTL = 12
+
+	for _, test := range tests {
+		if ttl := worker.receivedTTL(test.received); ttl != test.ttl {
+			t.Errorf("%s: receivedTTL(%d) = %d, want %d", test.name, test.received, ttl, test.ttl)
+		}
+	}
+}
+
+func TestTTLExpired(t *testing.T) {
+	worker := newTestWorker("sensors/temp")
+
+	if worker.ttlExpired(1, PubId{OriginId: 2, Seqn: 1}) {
+		t.Fatal("pub with a hop left expired")
+	}
+
+	if !worker.ttlExpired(0, PubId{OriginId: 2, Seqn: 1}) {
+		t.Fatal("pub without hops left kept")
+	}
+
+	if expired := worker.Ctx.Metrics.Counter("routing.ttl_expired"); expired != 1 {
+		t.Fatalf("%d expired pubs counted, want 1", expired)
+	}
+}
@@ -47,9 +47,11 @@ type CoreBroker struct {
 	Id                   int64
 	LatestSeqn           int
 	Dist                 int
+	Priority             int
 	LastHeard            time.Time
 	Parents              []Parent
 	HasUnansweredParents bool
+	Candidates           []int64 // neighbors at the parents distance in the latest round that are not parents
 }
 
 type Core struct {
@@ -63,15 +65,31 @@ type Parent struct {
 }
 
 type TopicWorker struct {
-	Topic        string
-	Ctx          *FederatorContext
-	Channel      chan Message
-	Cache        *lru.Cache
-	NextId       int
-	LatestBeacon time.Time
-	CurrentCore  Core
-	Children     map[int64]time.Time
-	SessionKey   []byte
+	Topic           string
+	Ctx             *FederatorContext
+	Channel         chan Message
+	Cache           *lru.Cache
+	NextId          int
+	LatestBeacon    time.Time
+	CurrentCore     Core
+	Children        map[int64]time.Time
+	SessionKey      []byte
+	EncryptionKey   []byte   // derived from the session key, encrypts the secure pubs
+	MacKey          [16]byte // derived from the session key, authenticates the secure pubs
+	Replay          *ReplayWindow
+	Retained        *lru.Cache // last retained RoutedPub of each concrete topic
+	Pending         map[pendingKey]*pendingPub
+	RetransmitTimer *time.Timer
+	Streams         map[streamKey]*originStream // per origin order of the ordered topics
+	OrderTimer      *time.Timer
+	RepairBuffer    *lru.Cache               // recent RoutedPubs that children can ask for again
+	Gaps            map[streamKey]*gapStream // per origin sequence gaps of the repaired topics
+	RepairTimer     *time.Timer
+	Partials        map[fragmentKey]*partialPub // fragmented pubs being reassembled
+	ReassemblyTimer *time.Timer
+	BeaconTimer     *time.Timer // fires when the latest beacon expires
+	CoreTimer       *time.Timer // fires when the current core would time out
+	FailoverStarted time.Time   // when the last core was lost, zero if there is a core
 }
 
 // Run starts the topic worker
@@ -86,6 +104,18 @@ func (t TopicWorker) Run() {
 			t.handleSecureRoutedPub(msg.SecureRoutedPub)
 		} else if msg.Type == "RoutedPub" {
 			t.handleRoutedPub(msg.RoutedPub)
+		} else if msg.Type == "RoutedPubAck" {
+			t.handleRoutedPubAck(msg.RoutedPubAck)
+		} else if msg.Type == "RetransmitTick" {
+			t.handleRetransmitTick()
+		} else if msg.Type == "OrderTick" {
+			t.handleOrderTick()
+		} else if msg.Type == "MeshNack" {
+			t.handleNack(msg.MeshNack)
+		} else if msg.Type == "RepairTick" {
+			t.handleRepairTick()
+		} else if msg.Type == "ReassemblyTick" {
+			t.handleReassemblyTick()
 		} else if msg.Type == "SecureFederatedPub" {
 			t.handleSecureFederatedPub(msg.SecureFederatedPub)
 		} else if msg.Type == "FederatedPub" {
@@ -100,6 +130,22 @@ func (t TopicWorker) Run() {
 			t.handleSecureBeacon(msg.SecureBeacon)
 		} else if msg.Type == "Beacon" {
 			t.handleBeacon()
+		} else if msg.Type == "BeaconTick" {
+			t.handleBeaconTick()
+		} else if msg.Type == "CoreWithdrawal" {
+			t.handleCoreWithdrawal(msg.CoreWithdrawal)
+		} else if msg.Type == "LinkLost" {
+			t.handleLinkLost(msg.LinkLost)
+		} else if msg.Type == "CoreTick" {
+			t.handleCoreTick()
+		} else if msg.Type == "MeshMembLeave" {
+			t.handleMembLeave(msg.MeshMembLeave)
+		} else if msg.Type == "TraceRequest" {
+			t.handleTraceRequest(msg.TraceRequest)
+		} else if msg.Type == "Trace" {
+			t.handleTrace(msg.Trace)
+		} else if msg.Type == "TraceReply" {
+			t.relayTraceReply(msg.TraceReply)
 		}
 	}
 
@@ -123,44 +169,93 @@ func (t *TopicWorker) handleNodeAnn(nodeAnn NodeAnn) {
 		t.Cache.Remove(string(nodeAnn.Password))
 	})
 
-	if nodeAnn.Id == t.Ctx.Id {
+	if nodeAnn.Id == t.Ctx.id() {
 		return
 	}
 
 	if nodeAnn.Action == "UPDATE_PASSWORD" {
 		fmt.Println("Updating topic password", string(nodeAnn.Password), t.Topic)
-		t.SessionKey = nodeAnn.Password
+		t.setSessionKey(nodeAnn.Password)
 	}
 }
 
+// setSessionKey stores the session key of the topic and derives
+// from it the separate encryption and MAC keys of the secure pubs
+func (t *TopicWorker) setSessionKey(sessionKey []byte) {
+	t.SessionKey = sessionKey
+	t.EncryptionKey, t.MacKey = keys.TopicKeys(sessionKey, t.Topic)
+}
+
 // handleRoutedPub handles a routed publication
 func (t *TopicWorker) handleRoutedPub(routedPub RoutedPub) {
 	fmt.Println("Routed Pub ", t.Topic, " received: ", string(routedPub.Payload))
 
-	// Check if the cache contains the publication ID
-	if t.Cache.Contains(routedPub.PubId) {
+	// fragments are joined before anything else, the whole pub is acked once
+	if routedPub.Fragment != nil {
+		whole, ok := t.reassemble(routedPub)
+		if !ok {
+			return
+		}
+		routedPub = whole
+	}
+
+	t.ackRoutedPub(routedPub)
+
+	routedPub.TTL = t.receivedTTL(routedPub.TTL)
+	if t.ttlExpired(routedPub.TTL, routedPub.PubId) {
 		return
 	}
 
-	// Add the publication ID to the cache
-	t.Cache.Add(routedPub.PubId, true)
+	// a delayed pub comes back already in the cache
+	if !routedPub.admitted {
+		// Check if the cache contains the publication ID
+		if t.Cache.Contains(routedPub.key(t.Topic)) {
+			return
+		}
 
-	// Check if the topic worker has local subscribers
-	// and send the publication to the local subscribers (sensors and stuff)
-	if t.hasLocalSub() {
-		fmt.Println("sending pub to local subs ", t.Topic)
+		// Add the publication ID to the cache
+		t.Cache.Add(routedPub.key(t.Topic), true)
 
-		_, err := t.Ctx.HostClient.Publish(t.Topic, string(routedPub.Payload), 2, false)
+		originKey := routedPub.deliveryTopic(t.Topic) + "/" + strconv.FormatInt(routedPub.PubId.OriginId, 10)
+		wait, ok := t.throttle("origin", originKey, t.policy(routedPub.deliveryTopic(t.Topic)).OriginLimit)
 
-		if err != nil {
-			fmt.Println("Error while send to local subscribers ", err)
+		if !ok {
+			return
+		}
+
+		if wait > 0 {
+			routedPub.admitted = true
+			t.delay(wait, Message{Type: "RoutedPub", Topic: t.Topic, RoutedPub: routedPub})
+			return
 		}
 	}
 
-	senderId := routedPub.SenderId
-	routedPub.SenderId = t.Ctx.Id
+	// the hop limit stops a pub looping through inconsistent parents and children,
+	// it is decremented before the pub is kept so repairs and retained replays
+	// leave with the hops of a forward
+	routedPub.TTL -= 1
 
-	topic, replieRoutedPub := routedPub.Serialize(t.Topic)
+	qos := t.policy(routedPub.deliveryTopic(t.Topic)).CapQos(routedPub.Qos)
+	t.keepRetained(routedPub)
+	t.keepForRepair(routedPub)
+	t.trackGaps(routedPub, routedPub.SenderId)
+
+	// Check if the topic worker has local subscribers
+	// and send the publication to the local subscribers (sensors and stuff)
+	if t.hasLocalSub() && t.firstDelivery(routedPub) {
+		if t.policy(routedPub.deliveryTopic(t.Topic)).Ordered {
+			t.deliverOrdered(routedPub, qos)
+		} else {
+			t.deliverLocal(routedPub, qos)
+		}
+	}
+
+	if t.ttlExpired(routedPub.TTL, routedPub.PubId) {
+		return
+	}
+
+	senderId := routedPub.SenderId
+	routedPub.SenderId = t.Ctx.id()
 
 	// send to mesh parents
 	var parents []int64
@@ -171,20 +266,48 @@ func (t *TopicWorker) handleRoutedPub(routedPub RoutedPub) {
 	}
 
 	fmt.Println("Routed Pub Sending to parents: ", parents)
-	SendTo(topic, replieRoutedPub, parents, t.Ctx.Neighbors)
+	t.sendRoutedPub(routedPub, qos, parents)
+	t.expectAcks(routedPub, parents)
 
 	// send to mesh children
 	var children []int64
 	for id, child := range t.Children {
 		elapsed := time.Since(child)
 
-		if id != senderId && elapsed < 3*t.Ctx.CoreAnnInterval {
+		if id != senderId && elapsed < 3*t.Ctx.coreAnnInterval() {
 			children = append(children, id)
 		}
 	}
 
 	fmt.Println("Routed Pub Sending to children: ", children)
-	SendTo(topic, replieRoutedPub, children, t.Ctx.Neighbors)
+	t.sendRoutedPub(routedPub, qos, children)
+	t.expectAcks(routedPub, children)
+}
+
+// deliverLocal sends a routed publication to the local subscribers
+func (t *TopicWorker) deliverLocal(routedPub RoutedPub, qos byte) {
+	fmt.Println("sending pub to local subs ", routedPub.deliveryTopic(t.Topic))
+
+	props, ok := remainingExpiry(routedPub.Properties, routedPub.Timestamp)
+
+	if !ok {
+		fmt.Println("Pub", routedPub.PubId, "expired before its delivery, dropping")
+		t.Ctx.Metrics.Inc("delivery.expired")
+		return
+	}
+
+	payload, err := decompressPayload(routedPub.Encoding, routedPub.Payload)
+
+	if err != nil {
+		fmt.Println("Error while decompressing the payload", err)
+		return
+	}
+
+	_, err = t.Ctx.hostClient().PublishWithProperties(routedPub.deliveryTopic(t.Topic), payload, qos, routedPub.Retain, props)
+
+	if err != nil {
+		fmt.Println("Error while send to local subscribers ", err)
+	}
 }
 
 // handleSecureRoutedPub handles a secure routed publication
@@ -202,11 +325,18 @@ func (t *TopicWorker) handleSecureRoutedPub(secureRoutedPub SecureRoutedPub) {
 	// Add the publication ID to the cache
 	t.Cache.Add(secureRoutedPub.PubId, true)
 
+	secureRoutedPub.TTL = t.receivedTTL(secureRoutedPub.TTL)
+	if t.ttlExpired(secureRoutedPub.TTL, secureRoutedPub.PubId) {
+		return
+	}
+
+	qos := t.policy(t.Topic).CapQos(secureRoutedPub.Qos)
+
 	// Check if the topic worker has local subscribers
 	// and send the publication to the local subscribers (sensors and stuff)
 	if t.hasLocalSub() {
 		// It only decrypts the payload if it has local subscribers
-		payload, er := keys.DecryptSimple(secureRoutedPub.Payload, t.SessionKey)
+		payload, er := keys.DecryptSimple(secureRoutedPub.Payload, t.EncryptionKey)
 
 		if er != nil {
 			fmt.Println("Error while decrypting the payload", er)
@@ -215,24 +345,49 @@ func (t *TopicWorker) handleSecureRoutedPub(secureRoutedPub SecureRoutedPub) {
 			fmt.Println("Payload decrypted successfully", string(payload))
 		}
 
-		var sessionKey [16]byte
-		copy(sessionKey[:], t.SessionKey[:16])
-		if !keys.ValidateMAC(sessionKey, payload, secureRoutedPub.Mac) {
+		macInput := secureMacInput(t.Topic, secureRoutedPub.PubId, secureRoutedPub.Timestamp, secureRoutedPub.Properties, secureRoutedPub.Encoding, payload)
+		if !keys.ValidateMAC(t.MacKey, macInput, secureRoutedPub.Mac) {
 			fmt.Println("Message was tampered")
 			return
 		}
 
+		// the MAC is valid so the origin and timestamp are authentic,
+		// only now can they be checked against the replay window
+		if !t.Replay.Accept(secureRoutedPub.PubId.OriginId, secureRoutedPub.PubId.Seqn, secureRoutedPub.Timestamp) {
+			fmt.Println("Replayed secure pub from", secureRoutedPub.PubId.OriginId, "dropped")
+			return
+		}
+
+		payload, er = decompressPayload(secureRoutedPub.Encoding, payload)
+
+		if er != nil {
+			fmt.Println("Error while decompressing the payload", er)
+			return
+		}
+
 		fmt.Println("sending pub to local subs ", t.Topic)
 
-		_, err := t.Ctx.HostClient.Publish(t.Topic, string(payload), 2, false)
+		props, ok := remainingExpiry(secureRoutedPub.Properties, secureRoutedPub.Timestamp)
 
-		if err != nil {
-			fmt.Println("Error while send to local subscribers ", err)
+		if ok {
+			_, err := t.Ctx.hostClient().PublishWithProperties(t.Topic, payload, qos, secureRoutedPub.Retain, props)
+
+			if err != nil {
+				fmt.Println("Error while send to local subscribers ", err)
+			}
+		} else {
+			fmt.Println("Pub", secureRoutedPub.PubId, "expired before its delivery, dropping")
+			t.Ctx.Metrics.Inc("delivery.expired")
 		}
 	}
 
+	secureRoutedPub.TTL -= 1
+	if t.ttlExpired(secureRoutedPub.TTL, secureRoutedPub.PubId) {
+		return
+	}
+
 	senderId := secureRoutedPub.SenderId
-	secureRoutedPub.SenderId = t.Ctx.Id
+	secureRoutedPub.SenderId = t.Ctx.id()
 
 	topic, replieRoutedPub := secureRoutedPub.Serialize(t.Topic)
 
@@ -246,19 +401,19 @@ func (t *TopicWorker) handleSecureRoutedPub(secureRoutedPub SecureRoutedPub) {
 	}
 
 	fmt.Println("Secure Routed Pub Sending to parents: ", parents)
-	SendTo(topic, replieRoutedPub, parents, t.Ctx.Neighbors)
+	t.sendTo(topic, replieRoutedPub, qos, parents)
 
 	// send to mesh children
 	for id, child := range t.Children {
 		elapsed := time.Since(child)
 
-		if id != senderId && elapsed < 3*t.Ctx.CoreAnnInterval {
+		if id != senderId && elapsed < 3*t.Ctx.coreAnnInterval() {
 			children = append(children, id)
 		}
 	}
 
 	fmt.Println("Secure Routed Pub Sending to children: ", children)
-	SendTo(topic, replieRoutedPub, children, t.Ctx.Neighbors)
+	t.sendTo(topic, replieRoutedPub, qos, children)
 
 }
 
@@ -268,28 +423,36 @@ func (t *TopicWorker) handleSecureRoutedPub(secureRoutedPub SecureRoutedPub) {
 func (t *TopicWorker) handleFederatedPub(msg FederatedPub) {
 	fmt.Println("Federted Pub ", t.Topic, " received: ", string(msg.Payload))
 
-	newId := PubId{
-		OriginId: t.Ctx.Id,
-		Seqn:     t.NextId,
+	pub := RoutedPub{
+		PubId:      msg.PubId,
+		Payload:    msg.Payload,
+		SenderId:   t.Ctx.id(),
+		Qos:        msg.Qos,
+		Retain:     msg.Retain,
+		Reliable:   t.policy(msg.Topic).Reliable,
+		Properties: msg.Properties,
+		TTL:        t.Ctx.hopLimit(),
+		Timestamp:  time.Now().UnixNano(),
 	}
 
-	t.NextId += 1
+	// filter meshes carry the concrete topic for the final delivery
+	if msg.Topic != t.Topic {
+		pub.Topic = msg.Topic
+	}
 
 	// Check if the cache contains the publication ID
-	if t.Cache.Contains(newId) {
+	if t.Cache.Contains(pub.key(t.Topic)) {
 		return
 	}
 
 	// Add the publication ID to the cache
-	t.Cache.Add(newId, true)
+	t.Cache.Add(pub.key(t.Topic), true)
 
-	pub := RoutedPub{
-		PubId:    newId,
-		Payload:  msg.Payload,
-		SenderId: t.Ctx.Id,
-	}
+	pub.Payload, pub.Encoding = t.compress(msg.Topic, msg.Payload)
 
-	topic, routedPub := pub.Serialize(t.Topic)
+	qos := t.policy(msg.Topic).CapQos(msg.Qos)
+	t.keepRetained(pub)
+	t.keepForRepair(pub)
 
 	// send to mesh parents
 	var parents []int64
@@ -298,20 +461,22 @@ func (t *TopicWorker) handleFederatedPub(msg FederatedPub) {
 	}
 
 	fmt.Println("Federted Pub Sending to parents: ", parents)
-	SendTo(topic, routedPub, parents, t.Ctx.Neighbors)
+	t.sendRoutedPub(pub, qos, parents)
+	t.expectAcks(pub, parents)
 
 	// send to mesh children
 	var children []int64
 	for id, child := range t.Children {
 		elapsed := time.Since(child)
 
-		if elapsed < 3*t.Ctx.CoreAnnInterval {
+		if elapsed < 3*t.Ctx.coreAnnInterval() {
 			children = append(children, id)
 		}
 	}
 
 	fmt.Println("Federted Pub Sending to children: ", children)
-	SendTo(topic, routedPub, children, t.Ctx.Neighbors)
+	t.sendRoutedPub(pub, qos, children)
+	t.expectAcks(pub, children)
 }
 
 // handleSecureFederatedPub handles a secure federated publication
@@ -326,7 +491,10 @@ func (t *TopicWorker) handleSecureFederatedPub(msg SecureFederatedPub) {
 
 	fmt.Println("Session key: ", string(t.SessionKey))
 
-	payload, err := keys.EncryptSimple(msg.Payload, t.SessionKey)
+	// compressed before the encryption, ciphertext does not compress
+	plaintext, encoding := t.compress(t.Topic, msg.Payload)
+
+	payload, err := keys.EncryptSimple(plaintext, t.EncryptionKey)
 
 	if err != nil {
 		fmt.Println("Error while encrypting the payload", err)
@@ -334,28 +502,37 @@ func (t *TopicWorker) handleSecureFederatedPub(msg SecureFederatedPub) {
 		fmt.Println("Payload encrypted successfully", payload)
 	}
 
-	var sessionKey [16]byte
-	copy(sessionKey[:], t.SessionKey[:16])
-	mac := keys.GenerateMAC(sessionKey, msg.Payload)
-
 	newId := PubId{
-		OriginId: t.Ctx.Id,
+		OriginId: t.Ctx.id(),
+		Epoch:    t.Ctx.Epoch,
 		Seqn:     t.NextId,
 	}
 
 	t.NextId += 1
 
+	timestamp := time.Now().UnixNano()
+
+	mac := keys.GenerateMAC(t.MacKey, secureMacInput(t.Topic, newId, timestamp, msg.Properties, encoding, plaintext))
+
 	pub := SecureRoutedPub{
-		PubId:    newId,
-		Payload:  payload,
-		SenderId: t.Ctx.Id,
-		Mac:      mac,
+		PubId:      newId,
+		Payload:    payload,
+		SenderId:   t.Ctx.id(),
+		Timestamp:  timestamp,
+		Qos:        msg.Qos,
+		Retain:     msg.Retain,
+		Properties: msg.Properties,
+		Encoding:   encoding,
+		TTL:        t.Ctx.hopLimit(),
+		Mac:        mac,
 	}
 
 	topic, secureRoutedPub := pub.Serialize(t.Topic)
 	fmt.Println("Secure Federted Pub after: ", string(secureRoutedPub))
 
 	t.Cache.Add(newId, true)
+	qos := t.policy(t.Topic).CapQos(msg.Qos)
+
 	var parents, children []int64
 
 	// send to mesh parents
@@ -364,19 +541,19 @@ func (t *TopicWorker) handleSecureFederatedPub(msg SecureFederatedPub) {
 	}
 
 	fmt.Println("Secure Federted Pub Sending to parents: ", parents)
-	SendTo(topic, secureRoutedPub, parents, t.Ctx.Neighbors)
+	t.sendTo(topic, secureRoutedPub, qos, parents)
 
 	// send to mesh children
 	for id, child := range t.Children {
 		elapsed := time.Since(child)
 
-		if elapsed < 3*t.Ctx.CoreAnnInterval {
+		if elapsed < 3*t.Ctx.coreAnnInterval() {
 			children = append(children, id)
 		}
 	}
 
 	fmt.Println("Federted Pub Sending to children: ", children)
-	SendTo(topic, secureRoutedPub, children, t.Ctx.Neighbors)
+	t.sendTo(topic, secureRoutedPub, qos, children)
 }
 
 // handleCoreAnn handles a core announcement
@@ -386,33 +563,40 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 	// if the core ann is from the current core or from the sender, ignore it
 	// because we are not interested in our own core anns or in core anns from
 	// the core that we are receiving the core anns
-	if coreAnn.CoreId == t.Ctx.Id || coreAnn.SenderId == t.Ctx.Id {
+	if coreAnn.CoreId == t.Ctx.id() || coreAnn.SenderId == t.Ctx.id() {
 		return
 	}
 
 	fmt.Println("Core Ann ", t.Topic, " received: ", coreAnn)
 
-	coreAnn.Dist += 1
+	// once another core is followed its liveness is checked and a failover ends
+	defer func() {
+		if _, ok := FilterValid(t.CurrentCore, t.Ctx.coreTimeout()).(CoreBroker); ok {
+			t.coreElected()
+		}
+	}()
+
+	// the distance is the sum of the link costs towards the core, it is only
+	// ever increased here, by the cost of the link the core ann came through
+	coreAnn.Dist += t.Ctx.linkCost(coreAnn.SenderId)
 
 	// filter the core information and get the valid core
-	core := FilterValid(t.CurrentCore, t.Ctx.CoreAnnInterval)
+	core := FilterValid(t.CurrentCore, t.Ctx.coreTimeout())
 	fmt.Println("Core: ", core)
 
 	if core != nil {
-		currentCoreId := t.Ctx.Id
-
-		if c, ok := core.(CoreBroker); ok {
-			currentCoreId = c.Id
-		}
+		current := t.currentCandidate(core)
+		currentCoreId := current.Id
 
 		if coreAnn.CoreId == currentCoreId {
 			core := core.(CoreBroker)
-			// received a core ann with a diferent distance to the core: because we
-			// are keeping only parents with same distance, the current parents are no
-			// longer valid, so we clean the parents list and add the neighbor from the
-			// receiving core ann as unique parent for now
-			if coreAnn.Seqn > core.LatestSeqn || coreAnn.Dist <= core.Dist {
+			// received a core ann of a new round or with a shorter distance to the
+			// core: because we are keeping only parents with same distance, the current
+			// parents are no longer valid, so we clean the parents list and add the
+			// neighbor from the receiving core ann as unique parent for now
+			if coreAnn.Seqn > core.LatestSeqn || coreAnn.Dist < core.Dist {
 				t.CurrentCore.Other.LatestSeqn = coreAnn.Seqn
+				t.CurrentCore.Other.Priority = coreAnn.Priority
 				t.CurrentCore.Other.Dist = coreAnn.Dist
 				t.CurrentCore.Other.LastHeard = time.Now()
 
@@ -424,7 +608,8 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 				}
 
 				t.CurrentCore.Other.Parents = t.CurrentCore.Other.Parents[:0]
-				fmt.Println("Adding parent ", coreAnn.SenderId, " to ", t.Ctx.Id)
+				t.CurrentCore.Other.Candidates = nil
+				fmt.Println("Adding parent ", coreAnn.SenderId, " to ", t.Ctx.id())
 				t.CurrentCore.Other.Parents = append(t.CurrentCore.Other.Parents, Parent{
 					Id:          coreAnn.SenderId,
 					WasAnswered: wasAnswered,
@@ -433,61 +618,39 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 
 				t.forward(coreAnn)
 
-				// neighbor is not already a parent: make it parent if the redundancy
-				// permits or if it has a lower id
-			} else if coreAnn.Seqn == core.LatestSeqn || coreAnn.Dist == core.Dist {
-
-				var isParent bool
-
-				// check if the neighbor is already a parent
-				for _, p := range core.Parents {
-					if p.Id == coreAnn.SenderId {
-						isParent = true
+				// neighbor with the same distance in the same round: make it parent if
+				// the redundancy permits, otherwise keep it as a candidate
+			} else if coreAnn.Seqn == core.LatestSeqn && coreAnn.Dist == core.Dist {
+				if !isParent(core.Parents, coreAnn.SenderId) {
+					if len(core.Parents) < t.Ctx.redundancy() {
+						t.addParent(coreAnn, coreAnn.SenderId)
+					} else {
+						t.addCandidate(coreAnn.SenderId)
 					}
 				}
 
-				// if the neighbor is not a parent, add it as a parent if the redundancy
-				if !isParent {
-					// check if the redundancy permits
-					if len(core.Parents) <= t.Ctx.Redundancy {
-						// check if the neighbor has local subscribers
-						if len(core.Parents) == t.Ctx.Redundancy {
-							t.CurrentCore.Other.Parents = t.CurrentCore.Other.Parents[:len(t.CurrentCore.Other.Parents)-1]
-						}
-
-						wasAnswered := false
-
-						// check if the neighbor has local subscribers
-						if hasLocalSub(t.LatestBeacon, t.Ctx) {
-							answer(coreAnn, t.Topic, t.Ctx)
-							wasAnswered = true
-						}
-
-						// add the neighbor as a parent
-						parent := Parent{
-							Id:          coreAnn.SenderId,
-							WasAnswered: wasAnswered,
-						}
-
-						fmt.Println("Adding parent ", parent.Id, " to ", t.Ctx.Id)
-
-						t.CurrentCore.Other.Parents = append(t.CurrentCore.Other.Parents, parent)
-						t.CurrentCore.Other.HasUnansweredParents = !wasAnswered
-					}
-				}
+				// ranked on the anns of the parents too, so a parent whose
+				// link degrades is swapped out even if no new neighbor shows up
+				t.rankParents(coreAnn)
 			}
-			// received a core ann from a core with a higher id: depose the current core
-		} else if coreAnn.CoreId < currentCoreId {
+			// received a core ann from a better candidate (by default a higher
+			// priority or, on a tie, a lower id): depose the current core
+		} else if t.Ctx.election().Better(Candidate{Id: coreAnn.CoreId, Priority: coreAnn.Priority}, current) {
 			fmt.Println(currentCoreId, " Core deposed", coreAnn.CoreId, " New core elected")
 			fmt.Println("Children on : ", t.Children, "will be empty")
 
-			if coreAnn.CoreId == t.Ctx.Id {
+			// this federator was announcing itself, it is not the core anymore
+			if announcer, ok := core.(Announcer); ok {
+				announcer.Drop()
+			}
+
+			if coreAnn.CoreId == t.Ctx.id() {
 				newNodeAnn := NodeAnn{
-					Id:     t.Ctx.Id,
+					Id:     t.Ctx.id(),
 					Topic:  t.Topic,
 					Action: "UPDATE_CORE",
 				}
-				_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.Id, 10))
+				_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.id(), 10))
 
 				t.sendToTopology(payload)
 			}
@@ -517,6 +680,7 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 					LatestSeqn:           coreAnn.Seqn,
 					LastHeard:            time.Now(),
 					Dist:                 coreAnn.Dist,
+					Priority:             coreAnn.Priority,
 					HasUnansweredParents: !wasAnswered,
 				},
 			}
@@ -551,6 +715,7 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 				LatestSeqn:           coreAnn.Seqn,
 				LastHeard:            time.Now(),
 				Dist:                 coreAnn.Dist,
+				Priority:             coreAnn.Priority,
 				HasUnansweredParents: !wasAnswered,
 			},
 		}
@@ -562,13 +727,13 @@ func (t *TopicWorker) handleCoreAnn(coreAnn CoreAnn) {
 		t.forward(coreAnn)
 
 		// if the core ann is from the current core, update the core
-		if coreAnn.CoreId == t.Ctx.Id {
+		if coreAnn.CoreId == t.Ctx.id() {
 			newNodeAnn := NodeAnn{
-				Id:     t.Ctx.Id,
+				Id:     t.Ctx.id(),
 				Topic:  t.Topic,
 				Action: "UPDATE_CORE",
 			}
-			_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.Id, 10))
+			_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.id(), 10))
 
 			t.sendToTopology(payload)
 		}
@@ -580,32 +745,38 @@ func (t *TopicWorker) handleMembAnn(membAnn MeshMembAnn) {
 	fmt.Println("Memb Ann ", t.Topic, " received: ", membAnn)
 
 	// if the memb ann is from the current core or from the sender, ignore it
-	if membAnn.CoreId == t.Ctx.Id || membAnn.SenderId == t.Ctx.Id {
+	if membAnn.CoreId == t.Ctx.id() || membAnn.SenderId == t.Ctx.id() {
 		return
 	}
 
 	// if the memb ann seqn is the same as the latest seqn, answer the parents
 	if membAnn.Seqn == t.CurrentCore.Other.LatestSeqn {
-		fmt.Println("Adding child ", membAnn.SenderId, " to ", t.Ctx.Id)
+		fmt.Println("Adding child ", membAnn.SenderId, " to ", t.Ctx.id())
+		isNewChild := !t.isActiveChild(membAnn.SenderId)
 		t.Children[membAnn.SenderId] = time.Now()
 		answerParents(&t.CurrentCore.Other, t.Ctx, t.Topic)
 
-		if t.Ctx.Neighbors[membAnn.SenderId] != nil {
+		// a late joiner gets the last retained value without waiting for the next publish
+		if isNewChild {
+			t.sendRetained(membAnn.SenderId)
+		}
+
+		if t.Ctx.neighbor(membAnn.SenderId) != nil {
 			fmt.Println("Sending my memb ack using key ", t.SessionKey)
 
 			pub := MeshMembAck{
 				CoreId:     t.CurrentCore.Other.Id,
 				Seqn:       t.CurrentCore.Other.LatestSeqn,
-				SenderId:   t.Ctx.Id,
+				SenderId:   t.Ctx.id(),
 				SessionKey: t.SessionKey,
 			}
 
 			// serialize the mesh ack announcement
 			topic, myMembAck := pub.Serialize(t.Topic)
 
-			if t.Ctx.Neighbors[membAnn.SenderId] != nil {
+			if t.Ctx.neighbor(membAnn.SenderId) != nil {
 				fmt.Println("Sending my memb ack CHILD to ", membAnn.SenderId, " On topic ", topic)
-				_, err := t.Ctx.Neighbors[membAnn.SenderId].Publish(topic, string(myMembAck), 2, false)
+				err := t.Ctx.neighbor(membAnn.SenderId).PublishAsync(topic, string(myMembAck), 2, false)
 
 				if err != nil {
 					fmt.Println("error while send my memb ack")
@@ -618,7 +789,7 @@ func (t *TopicWorker) handleMembAnn(membAnn MeshMembAnn) {
 // handleMembAck handles a mesh membership acknowledgment
 // it checks if the shared key matches and updates the shared key
 func (t *TopicWorker) handleMembAck(membAck MeshMembAck) {
-	if membAck.SenderId == t.Ctx.Id || membAck.CoreId == t.Ctx.Id {
+	if membAck.SenderId == t.Ctx.id() || membAck.CoreId == t.Ctx.id() {
 		return
 	}
 
@@ -637,9 +808,10 @@ func (t *TopicWorker) handleMembAck(membAck MeshMembAck) {
 // You must recieve a beacon to be a member of the federated topic network
 func (t *TopicWorker) handleBeacon() {
 	t.LatestBeacon = time.Now()
+	t.scheduleBeaconCheck()
 
 	// check if the current core has local subscribers
-	core := FilterValid(t.CurrentCore, t.Ctx.CoreAnnInterval)
+	core := FilterValid(t.CurrentCore, t.Ctx.coreTimeout())
 
 	if core != nil {
 		fmt.Println("Has Beancon for ", t.Topic)
@@ -656,6 +828,7 @@ func (t *TopicWorker) handleBeacon() {
 		t.CurrentCore = Core{
 			Myself: *announcer,
 		}
+		t.selfElected()
 
 		fmt.Println("Children on beacon: ", t.Children, "will be empty")
 		t.Children = make(map[int64]time.Time)
@@ -669,7 +842,7 @@ func (t *TopicWorker) handleBeacon() {
 func (t *TopicWorker) handleSecureBeacon(_ SecureBeacon) {
 	fmt.Println("Secure Beacon ", t.Topic, " received")
 
-	core := FilterValid(t.CurrentCore, t.Ctx.CoreAnnInterval)
+	core := FilterValid(t.CurrentCore, t.Ctx.coreTimeout())
 
 	// Check if the cache contains the publication ID
 	if t.Cache.Contains(t.Topic) {
@@ -686,21 +859,21 @@ func (t *TopicWorker) handleSecureBeacon(_ SecureBeacon) {
 	// I will be the core, must create a session key
 	if core == nil {
 		newNodeAnn := NodeAnn{
-			Id:     t.Ctx.Id,
+			Id:     t.Ctx.id(),
 			Topic:  t.Topic,
 			Action: "UPDATE_CORE",
 		}
-		_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.Id, 10))
+		_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.id(), 10))
 
 		t.sendToTopology(payload)
 	} else if t.SessionKey == nil || len(t.SessionKey) == 0 {
 		// Im sending join every time I receive a secure beacon, this is not correct
 		newNodeAnn := NodeAnn{
-			Id:     t.Ctx.Id,
+			Id:     t.Ctx.id(),
 			Topic:  t.Topic,
 			Action: "JOIN",
 		}
-		_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.Id, 10))
+		_, payload := newNodeAnn.Serialize(strconv.FormatInt(t.Ctx.id(), 10))
 
 		t.sendToTopology(payload)
 	}
@@ -708,6 +881,20 @@ func (t *TopicWorker) handleSecureBeacon(_ SecureBeacon) {
 	t.handleBeacon()
 }
 
+// policy returns the delivery policy of a concrete topic
+func (t TopicWorker) policy(topic string) TopicPolicy {
+	return t.Ctx.policy(topic)
+}
+
+// firstDelivery checks if the publication was not delivered to the local
+// broker yet, it may reach this federator over several meshes (the exact
+// topic and matching filters) but local subscribers must get it once
+func (t TopicWorker) firstDelivery(routedPub RoutedPub) bool {
+	contains, _ := t.Ctx.Delivered.ContainsOrAdd(routedPub.key(t.Topic), true)
+
+	return !contains
+}
+
 // hasLocalSub checks if the topic worker has local subscribers
 // by checking if the latest beacon time is not zero and if the
 // elapsed time is less than 3 times the beacon interval
@@ -718,7 +905,7 @@ func (t TopicWorker) hasLocalSub() bool {
 	if !t.LatestBeacon.IsZero() {
 		elapsed := time.Since(t.LatestBeacon)
 
-		return elapsed < 3*t.Ctx.BeaconInterval
+		return elapsed < 3*t.Ctx.beaconInterval()
 	} else {
 		return false
 	}
@@ -727,18 +914,19 @@ func (t TopicWorker) hasLocalSub() bool {
 // forwards (publish) a core announcement to the mesh neighbors
 func (t TopicWorker) forward(coreAnn CoreAnn) {
 	pub := CoreAnn{
-		Dist:     coreAnn.Dist + 1,
-		SenderId: t.Ctx.Id,
+		Dist:     coreAnn.Dist, // already includes the link it came through
+		SenderId: t.Ctx.id(),
 		Seqn:     coreAnn.Seqn,
 		CoreId:   coreAnn.CoreId,
+		Priority: coreAnn.Priority,
 	}
 
 	topic, myCoreAnn := pub.Serialize(t.Topic)
 
-	for id, ngbrClient := range t.Ctx.Neighbors {
+	for id, ngbrClient := range t.Ctx.neighbors() {
 		if id != coreAnn.SenderId {
 			fmt.Println("Forwarding core ann to", id, "On topic", topic)
-			_, err := ngbrClient.Publish(topic, string(myCoreAnn), 2, false)
+			err := ngbrClient.PublishAsync(topic, string(myCoreAnn), 2, false)
 			if err != nil {
 				fmt.Println("Error while forward message to", ngbrClient.ClientID)
 			}
@@ -751,8 +939,8 @@ func (t TopicWorker) forward(coreAnn CoreAnn) {
 // The message can be UPDATE_CORE, JOIN or LEAVE
 func (t TopicWorker) sendToTopology(message []byte) {
 
-	topic := NODE_ANN_LEVEL + strconv.FormatInt(t.Ctx.Id, 10)
-	payload, err := keys.Encrypt(message, t.Ctx.SharedKey)
+	topic := NODE_ANN_LEVEL + strconv.FormatInt(t.Ctx.id(), 10)
+	payload, err := keys.Encrypt(message, t.Ctx.sharedKey())
 
 	if err != nil {
 		fmt.Println("Error while encrypting the payload", err)
@@ -761,7 +949,7 @@ func (t TopicWorker) sendToTopology(message []byte) {
 
 	fmt.Println("Sending to topology", topic)
 
-	t.Ctx.TopologyClient.Publish(topic, string(payload), 2, false)
+	t.Ctx.topologyClient().Publish(topic, string(payload), 2, false)
 }
 
 // hasLocalSub checks if the topic worker has local subscribers
@@ -769,7 +957,7 @@ func hasLocalSub(latestBeacon time.Time, ctx *FederatorContext) bool {
 	if !latestBeacon.IsZero() {
 		elapsed := time.Since(latestBeacon)
 
-		return elapsed < 3*ctx.BeaconInterval
+		return elapsed < 3*ctx.beaconInterval()
 	} else {
 		return false
 	}
@@ -780,26 +968,35 @@ func hasLocalSub(latestBeacon time.Time, ctx *FederatorContext) bool {
 func NewTopicWorker(federatedTopic string, ctx *FederatorContext, channel chan Message) *TopicWorker {
 
 	cache, _ := lru.New(ctx.CacheSize)
+	retained, _ := lru.New(ctx.CacheSize)
+	repairBuffer, _ := lru.New(REPAIR_BUFFER_SIZE)
 	return &TopicWorker{
-		Topic:    federatedTopic,
-		Ctx:      ctx,
-		Channel:  channel,
-		Cache:    cache,
-		NextId:   0,
-		Children: make(map[int64]time.Time),
+		Topic:        federatedTopic,
+		Ctx:          ctx,
+		Channel:      channel,
+		Cache:        cache,
+		NextId:       0,
+		Children:     make(map[int64]time.Time),
+		Replay:       NewReplayWindow(ctx.ReplayWindow),
+		Retained:     retained,
+		Pending:      make(map[pendingKey]*pendingPub),
+		Streams:      make(map[streamKey]*originStream),
+		Gaps:         make(map[streamKey]*gapStream),
+		Partials:     make(map[fragmentKey]*partialPub),
+		RepairBuffer: repairBuffer,
 	}
 }
 
 // FilterValid filters the core information and returns the valid core
-func FilterValid(core Core, coreAnnInterval time.Duration) interface{} {
+func FilterValid(core Core, coreTimeout time.Duration) interface{} {
 	// deepequal is used to compare the core information
 	// if the core information is not empty, check if the
 	// other core is not empty and if the elapsed time is
-	// less than 3 times the core announcement interval
+	// less than the core timeout
 	if !reflect.DeepEqual(core.Other, CoreBroker{}) {
 		elapsed := time.Since(core.Other.LastHeard)
 
-		if elapsed < 3*coreAnnInterval {
+		if elapsed < coreTimeout {
 			return core.Other
 		}
 	} else if !reflect.DeepEqual(core.Myself, Announcer{}) {
@@ -809,8 +1006,11 @@ func FilterValid(core Core, coreAnnInterval time.Duration) interface{} {
 	return nil
 }
 
-// SendTo sends a message to the mesh neighbors
-func SendTo(topic string, message []byte, ids []int64, neighbors map[int64]*paho.Client) {
+// SendTo sends a message to the mesh neighbors,
+// the retain flag is never set between federators: a retained routed pub
+// would be delivered again to the federator on every resubscription,
+// it is only applied on the final delivery to local subscribers
+func SendTo(topic string, message []byte, qos byte, ids []int64, neighbors map[int64]*paho.Client) {
 	if len(ids) <= 0 {
 		return
 	}
@@ -826,7 +1026,7 @@ func SendTo(topic string, message []byte, ids []int64, neighbors map[int64]*paho
 		if neighbors[id] != nil {
 			fmt.Println("Sending:", topic, "With message:", string(message), "to ", id)
 
-			_, err := neighbors[id].Publish(topic, string(message), 2, false)
+			err := neighbors[id].PublishAsync(topic, string(message), qos, false)
 			if err != nil {
 				fmt.Println("problem creating or queuing the message for broker id ", id)
 			}
@@ -839,7 +1039,7 @@ func SendTo(topic string, message []byte, ids []int64, neighbors map[int64]*paho
 	if neighbors[firstId] != nil {
 		fmt.Println("Sending:", topic, "With message:", string(message), "to ", firstId)
 
-		_, err := neighbors[firstId].Publish(topic, string(message), 2, false)
+		err := neighbors[firstId].PublishAsync(topic, string(message), qos, false)
 
 		if err != nil {
 			fmt.Println("problem creating or queuing the message for broker id ", firstId)
@@ -857,7 +1057,7 @@ func answerParents(core *CoreBroker, context *FederatorContext, topic string) {
 		pub := MeshMembAnn{
 			CoreId:   core.Id,
 			Seqn:     core.LatestSeqn,
-			SenderId: context.Id,
+			SenderId: context.id(),
 		}
 
 		// serialize the mesh membership announcement
@@ -865,9 +1065,9 @@ func answerParents(core *CoreBroker, context *FederatorContext, topic string) {
 
 		for _, parent := range core.Parents {
 			if !parent.WasAnswered {
-				if context.Neighbors[parent.Id] != nil {
+				if context.neighbor(parent.Id) != nil {
 					fmt.Println("Sending my memb ann PARENTS to ", parent.Id, " On topic ", topic)
-					_, err := context.Neighbors[parent.Id].Publish(topic, string(myMembAnn), 2, false)
+					err := context.neighbor(parent.Id).PublishAsync(topic, string(myMembAnn), 2, false)
 					if err != nil {
 						fmt.Println("error while send my memb ann")
 					}
@@ -884,21 +1084,21 @@ func answerParents(core *CoreBroker, context *FederatorContext, topic string) {
 
 // Answers a core announcement with a mesh membership announcement
 func answer(coreAnn CoreAnn, topic string, context *FederatorContext) {
-	fmt.Println("Answering core ann from", coreAnn.SenderId, "as", context.Id, "On topic", topic)
+	fmt.Println("Answering core ann from", coreAnn.SenderId, "as", context.id(), "On topic", topic)
 
 	pub := MeshMembAnn{
 		CoreId:   coreAnn.CoreId,
 		Seqn:     coreAnn.Seqn,
-		SenderId: context.Id,
+		SenderId: context.id(),
 	}
 
 	// serialize the mesh membership announcement
 	topic, myMembAnn := pub.Serialize(topic)
 
 	// send the mesh membership announcement to the sender
-	if context.Neighbors[coreAnn.SenderId] != nil {
+	if context.neighbor(coreAnn.SenderId) != nil {
 		fmt.Println("Sending my memb ann to ", coreAnn.SenderId, " On topic ", topic)
-		_, err := context.Neighbors[coreAnn.SenderId].Publish(topic, string(myMembAnn), 2, false)
+		err := context.neighbor(coreAnn.SenderId).PublishAsync(topic, string(myMembAnn), 2, false)
 		if err != nil {
 			fmt.Println("error while send my memb ann to ", coreAnn.SenderId)
 		}
@@ -0,0 +1,429 @@
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mqtt-fed/application"
+	keys "mqtt-fed/infra/crypto"
+)
+
+const JOIN_PATH = "/api/v1/join"
+const HEARTBEAT_PATH = "/api/v1/heartbeat"
+
+// ErrUnknownNode is returned when the topology manager
+// does not know this federator anymore and it must join again
+var ErrUnknownNode = errors.New("topology manager does not know this node")
+
+// Config is a struct that
+// defines how a federator joins
+// the federated network
+type Config struct {
+	URL                string
+	AdvertisedListener string
+	NodeId             string
+	PrivateKey         *ecdsa.PrivateKey
+	PinnedServerKey    string // hex encoded public key expected from the topology manager
+	KeyDerivation      string // "hkdf" or empty for the legacy SHA-256 derivation
+	HTTPClient         *http.Client
+	Timeout            time.Duration // timeout of every request
+	MaxAttempts        int           // join attempts before falling back to the cache, 0 retries forever
+	InitialBackoff     time.Duration
+	MaxBackoff         time.Duration
+	CacheFile          string // last known config, empty disables the cache
+	HeartbeatInterval  time.Duration
+	MaxMissedBeats     int // consecutive heartbeat failures before joining again
+}
+
+// Bootstrapper joins the federated network
+// and keeps the federator registered with
+// the topology manager
+type Bootstrapper struct {
+	cfg    Config
+	client *http.Client
+	rejoin chan struct{}
+}
+
+// heartbeat is the body of the heartbeat request
+type heartbeat struct {
+	HardwareId string `json:"hardwareId"`
+}
+
+// ErrCacheKeyMismatch is returned when the cached config was joined with
+// another key pair, the shared key derived from it would not match the
+// one of the topology manager. Without a key store every start has a new key
+var ErrCacheKeyMismatch = errors.New("cached config was joined with another key")
+
+// cachedConfig is what is written to the cache file,
+// the data is kept exactly as the topology manager sent it
+type cachedConfig struct {
+	SavedAt   time.Time       `json:"savedAt"`
+	PublicKey string          `json:"publicKey"` // hex encoded key this federator joined with
+	Data      json.RawMessage `json:"data"`
+}
+
+// New creates a new Bootstrapper instance,
+// zero values in the config are replaced by defaults
+func New(cfg Config) *Bootstrapper {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.InitialBackoff <= 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.MaxMissedBeats <= 0 {
+		cfg.MaxMissedBeats = 3
+	}
+
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	// copy the client so the timeout never leaks into a shared one
+	withTimeout := *client
+	withTimeout.Timeout = cfg.Timeout
+
+	return &Bootstrapper{
+		cfg:    cfg,
+		client: &withTimeout,
+		rejoin: make(chan struct{}, 1),
+	}
+}
+
+// NewHTTPClient creates the HTTP client used to talk to the topology manager.
+// caFile trusts a private CA and pins restricts the accepted certificates
+// to the given SPKI SHA-256 pins. A plain http:// url is refused when any
+// of them is set
+func NewHTTPClient(url, caFile, pins string) (*http.Client, error) {
+	if caFile == "" && pins == "" {
+		return http.DefaultClient, nil
+	}
+
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("topology manager url must use https when a CA or pin is configured")
+	}
+
+	tlsConfig, err := keys.NewPinnedTLSConfig(caFile, pins)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// Join joins the federated network, retrying with exponential backoff.
+// When every attempt fails the last known config from the cache is used
+func (b *Bootstrapper) Join() (application.FederatorConfig, error) {
+	backoff := b.cfg.InitialBackoff
+
+	var lastErr error
+
+	for attempt := 1; b.cfg.MaxAttempts == 0 || attempt <= b.cfg.MaxAttempts; attempt++ {
+		config, err := b.join()
+
+		if err == nil {
+			return config, nil
+		}
+
+		lastErr = err
+		fmt.Println("Join attempt", attempt, "failed:", err)
+
+		if attempt == b.cfg.MaxAttempts {
+			break
+		}
+
+		fmt.Println("Retrying join in", backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > b.cfg.MaxBackoff {
+			backoff = b.cfg.MaxBackoff
+		}
+	}
+
+	fmt.Println("Could not join the federated network, trying the cached config")
+
+	config, err := b.loadCache()
+
+	if err != nil {
+		return application.FederatorConfig{}, fmt.Errorf("join failed: %v, cache: %v", lastErr, err)
+	}
+
+	return config, nil
+}
+
+// RequestRejoin asks the watcher to join again as soon as possible,
+// it is safe to call from any goroutine and never blocks
+func (b *Bootstrapper) RequestRejoin() {
+	select {
+	case b.rejoin <- struct{}{}:
+	default:
+	}
+}
+
+// Watch sends heartbeats to the topology manager and joins again when
+// the topology manager forgets this node, when too many heartbeats fail
+// or when RequestRejoin is called. Every new config is passed to apply
+func (b *Bootstrapper) Watch(apply func(application.FederatorConfig)) {
+	if b.cfg.HeartbeatInterval <= 0 {
+		// without heartbeats only explicit requests trigger a new join
+		for range b.rejoin {
+			b.rejoinAndApply(apply)
+		}
+
+		return
+	}
+
+	ticker := time.NewTicker(b.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	missed := 0
+
+	for {
+		select {
+		case <-b.rejoin:
+			missed = 0
+			b.rejoinAndApply(apply)
+		case <-ticker.C:
+			err := b.Heartbeat()
+
+			if err == nil {
+				missed = 0
+				continue
+			}
+
+			missed += 1
+			fmt.Println("Heartbeat failed", missed, "time(s):", err)
+
+			if errors.Is(err, ErrUnknownNode) || missed >= b.cfg.MaxMissedBeats {
+				missed = 0
+				b.rejoinAndApply(apply)
+			}
+		}
+	}
+}
+
+// Heartbeat tells the topology manager this node is still alive
+// returns ErrUnknownNode if the topology manager forgot it
+func (b *Bootstrapper) Heartbeat() error {
+	body, _ := json.Marshal(&heartbeat{HardwareId: b.cfg.NodeId})
+
+	response, err := b.post(HEARTBEAT_PATH, body)
+
+	if err != nil {
+		return err
+	}
+
+	if response.Code == http.StatusNotFound {
+		return ErrUnknownNode
+	}
+
+	if response.Code != http.StatusOK {
+		return errors.New(response.Description)
+	}
+
+	return nil
+}
+
+// rejoinAndApply joins again and hands the new config to apply,
+// failures are logged and the current config is kept
+func (b *Bootstrapper) rejoinAndApply(apply func(application.FederatorConfig)) {
+	fmt.Println("Joining the federated network again")
+
+	config, err := b.join()
+
+	if err != nil {
+		fmt.Println("Rejoin failed, keeping the current config:", err)
+		return
+	}
+
+	apply(config)
+}
+
+// join does a single join request and builds the federator config
+func (b *Bootstrapper) join() (application.FederatorConfig, error) {
+	body, _ := json.Marshal(&application.JoinRequest{
+		Ip:         b.cfg.AdvertisedListener,
+		PublicKey:  keys.ConvertECDSAPublicKeyToBytes(&b.cfg.PrivateKey.PublicKey),
+		HardwareId: b.cfg.NodeId,
+	})
+
+	fmt.Println("Joining the federated network with body: ", string(body))
+
+	response, err := b.post(JOIN_PATH, body)
+
+	if err != nil {
+		return application.FederatorConfig{}, err
+	}
+
+	if response.Code != http.StatusOK {
+		return application.FederatorConfig{}, errors.New(response.Description)
+	}
+
+	dataBytes, _ := json.Marshal(response.Data)
+
+	fmt.Println("Data bytes: ", string(dataBytes))
+
+	config, err := b.parse(dataBytes)
+
+	if err != nil {
+		return application.FederatorConfig{}, err
+	}
+
+	if err := b.saveCache(dataBytes); err != nil {
+		fmt.Println("Could not cache the config:", err)
+	}
+
+	return config, nil
+}
+
+// post sends a JSON body to the topology manager and decodes the response
+func (b *Bootstrapper) post(path string, body []byte) (*application.HTTPResponse, error) {
+	resp, err := b.client.Post(b.cfg.URL+path, "application/json", bytes.NewBuffer(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var response application.HTTPResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding %s response (status %d): %v", path, resp.StatusCode, err)
+	}
+
+	return &response, nil
+}
+
+// parse builds the federator config from the data sent by the topology
+// manager, checking the pinned key and deriving the shared key
+func (b *Bootstrapper) parse(data []byte) (application.FederatorConfig, error) {
+	var federatorConfig application.FederatorConfig
+
+	if err := json.Unmarshal(data, &federatorConfig); err != nil {
+		return federatorConfig, err
+	}
+
+	// a pinned key protects the control plane even when the join is not
+	// over HTTPS, a man in the middle can not swap in its own key
+	if err := keys.CheckPinnedKey(b.cfg.PinnedServerKey, federatorConfig.ServerPublicKey); err != nil {
+		return federatorConfig, err
+	}
+
+	serverKey, err := keys.ConvertBytesToECDSAPublicKey(b.cfg.PrivateKey, federatorConfig.ServerPublicKey)
+
+	if err != nil {
+		return federatorConfig, err
+	}
+
+	sharedKey, err := b.deriveSharedKey(serverKey)
+
+	if err != nil {
+		return federatorConfig, err
+	}
+
+	federatorConfig.CoreAnnInterval = time.Duration(federatorConfig.CoreAnnInterval)
+	federatorConfig.BeaconInterval = time.Duration(federatorConfig.BeaconInterval)
+	federatorConfig.PrivateKey = b.cfg.PrivateKey
+	federatorConfig.PublicKey = &b.cfg.PrivateKey.PublicKey
+	federatorConfig.SharedKey = sharedKey
+
+	return federatorConfig, nil
+}
+
+// deriveSharedKey derives the key used with the topology manager,
+// "hkdf" selects the HKDF key schedule bound to both public keys,
+// otherwise the legacy single SHA-256 hash is kept so older
+// topology managers can still decrypt our messages
+func (b *Bootstrapper) deriveSharedKey(serverKey *ecdsa.PublicKey) ([]byte, error) {
+	if b.cfg.KeyDerivation != "hkdf" {
+		return keys.GenerateSharedSecret(b.cfg.PrivateKey, serverKey)
+	}
+
+	secret, err := keys.GenerateRawSharedSecret(b.cfg.PrivateKey, serverKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := keys.NewKeySchedule(
+		secret,
+		keys.ConvertECDSAPublicKeyToBytes(&b.cfg.PrivateKey.PublicKey),
+		keys.ConvertECDSAPublicKeyToBytes(serverKey),
+	)
+
+	return schedule.ControlPlaneKey(), nil
+}
+
+// saveCache writes the data of the last successful join to disk
+func (b *Bootstrapper) saveCache(data []byte) error {
+	if b.cfg.CacheFile == "" {
+		return nil
+	}
+
+	cached, _ := json.Marshal(&cachedConfig{
+		SavedAt:   time.Now(),
+		PublicKey: b.publicKey(),
+		Data:      data,
+	})
+
+	if err := os.MkdirAll(filepath.Dir(b.cfg.CacheFile), 0700); err != nil {
+		return err
+	}
+
+	tmp := b.cfg.CacheFile + ".tmp"
+	if err := os.WriteFile(tmp, cached, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, b.cfg.CacheFile)
+}
+
+// loadCache reads the data of the last successful join from disk
+func (b *Bootstrapper) loadCache() (application.FederatorConfig, error) {
+	if b.cfg.CacheFile == "" {
+		return application.FederatorConfig{}, errors.New("no cache file configured")
+	}
+
+	data, err := os.ReadFile(b.cfg.CacheFile)
+
+	if err != nil {
+		return application.FederatorConfig{}, err
+	}
+
+	var cached cachedConfig
+
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return application.FederatorConfig{}, err
+	}
+
+	if cached.PublicKey != b.publicKey() {
+		return application.FederatorConfig{}, ErrCacheKeyMismatch
+	}
+
+	fmt.Println("Using config cached at", cached.SavedAt)
+
+	return b.parse(cached.Data)
+}
+
+// publicKey returns the hex encoded public key of this federator
+func (b *Bootstrapper) publicKey() string {
+	return hex.EncodeToString(keys.ConvertECDSAPublicKeyToBytes(&b.cfg.PrivateKey.PublicKey))
+}
@@ -0,0 +1,283 @@
+package bootstrap
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"mqtt-fed/application"
+	keys "mqtt-fed/infra/crypto"
+)
+
+// topologyManager is a fake topology manager, joins and heartbeats
+// are answered with the codes set by the test
+type topologyManager struct {
+	mu         sync.Mutex
+	key        *ecdsa.PrivateKey
+	nodeId     int64
+	failJoins  int // joins answered with an error before the first success
+	joins      int
+	joinTimes  []time.Time
+	heartbeats int
+	beatCode   int
+}
+
+func newTopologyManager(t *testing.T) *topologyManager {
+	return &topologyManager{
+		key:      newKey(t),
+		nodeId:   7,
+		beatCode: http.StatusOK,
+	}
+}
+
+func (m *topologyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	response := application.HTTPResponse{Code: http.StatusOK}
+
+	switch r.URL.Path {
+	case JOIN_PATH:
+		m.joins += 1
+		m.joinTimes = append(m.joinTimes, time.Now())
+
+		if m.joins <= m.failJoins {
+			response.Code = http.StatusServiceUnavailable
+			response.Description = "not ready"
+			break
+		}
+
+		response.Data = map[string]interface{}{
+			"id":        m.nodeId,
+			"publicKey": keys.ConvertECDSAPublicKeyToBytes(&m.key.PublicKey),
+			"neighbors": []application.NeighborConfig{},
+		}
+	case HEARTBEAT_PATH:
+		m.heartbeats += 1
+		response.Code = m.beatCode
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(&response)
+}
+
+// newKey generates a key whose coordinates use the whole curve size,
+// the public key encoding does not pad them
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	for {
+		key, _, err := keys.GenerateECDHKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys.ConvertECDSAPublicKeyToBytes(&key.PublicKey)) == 64 {
+			return key
+		}
+	}
+}
+
+func newTestBootstrapper(t *testing.T, url string, cfg Config) *Bootstrapper {
+	cfg.URL = url
+	cfg.NodeId = "hardware-1"
+	cfg.PrivateKey = newKey(t)
+
+	if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = 10 * time.Millisecond
+	}
+
+	return New(cfg)
+}
+
+func TestJoinRetriesWithBackoff(t *testing.T) {
+	manager := newTopologyManager(t)
+	manager.failJoins = 2
+
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 5, MaxBackoff: 15 * time.Millisecond})
+
+	config, err := b.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Id != manager.nodeId {
+		t.Fatalf("joined as %d, want %d", config.Id, manager.nodeId)
+	}
+
+	if manager.joins != 3 {
+		t.Fatalf("%d join requests, want 3", manager.joins)
+	}
+
+	// the first wait is the initial backoff, the second is doubled and capped
+	first := manager.joinTimes[1].Sub(manager.joinTimes[0])
+	second := manager.joinTimes[2].Sub(manager.joinTimes[1])
+
+	if first < 10*time.Millisecond || second < 15*time.Millisecond {
+		t.Fatalf("waited %v and %v between the attempts", first, second)
+	}
+}
+
+func TestJoinFallsBackToCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "config.json")
+
+	manager := newTopologyManager(t)
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 2, CacheFile: cacheFile})
+
+	if _, err := b.Join(); err != nil {
+		t.Fatal(err)
+	}
+
+	// from now on the topology manager refuses every join
+	manager.mu.Lock()
+	manager.failJoins = 1000
+	manager.joins = 0
+	manager.mu.Unlock()
+
+	config, err := b.Join()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Id != manager.nodeId || config.SharedKey == nil {
+		t.Fatalf("cached config not used: %+v", config)
+	}
+
+	if manager.joins != 2 {
+		t.Fatalf("%d join requests before using the cache, want 2", manager.joins)
+	}
+}
+
+func TestJoinRefusesCacheOfAnotherKey(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "config.json")
+
+	manager := newTopologyManager(t)
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 1, CacheFile: cacheFile})
+
+	if _, err := b.Join(); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.mu.Lock()
+	manager.failJoins = 1000
+	manager.joins = 0
+	manager.mu.Unlock()
+
+	// a restart without a key store comes back with a new key pair
+	restarted := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 1, CacheFile: cacheFile})
+
+	if _, err := restarted.Join(); err == nil {
+		t.Fatal("cached config used with another key")
+	}
+
+	if _, err := restarted.loadCache(); !errors.Is(err, ErrCacheKeyMismatch) {
+		t.Fatalf("loading the cache returned %v, want ErrCacheKeyMismatch", err)
+	}
+}
+
+func TestJoinFailsWithoutCache(t *testing.T) {
+	manager := newTopologyManager(t)
+	manager.failJoins = 1000
+
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 2})
+
+	if _, err := b.Join(); err == nil {
+		t.Fatal("join succeeded without topology manager and cache")
+	}
+}
+
+func TestWatchRejoinsOnUnknownNode(t *testing.T) {
+	manager := newTopologyManager(t)
+	manager.beatCode = http.StatusNotFound
+
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{HeartbeatInterval: 10 * time.Millisecond})
+
+	applied := make(chan application.FederatorConfig, 1)
+
+	go b.Watch(func(config application.FederatorConfig) {
+		select {
+		case applied <- config:
+		default:
+		}
+	})
+
+	select {
+	case config := <-applied:
+		if config.Id != manager.nodeId {
+			t.Fatalf("rejoined as %d, want %d", config.Id, manager.nodeId)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no rejoin after the topology manager forgot the node")
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.heartbeats == 0 || manager.joins == 0 {
+		t.Fatalf("%d heartbeats and %d joins", manager.heartbeats, manager.joins)
+	}
+}
+
+func TestHeartbeatUnknownNode(t *testing.T) {
+	manager := newTopologyManager(t)
+	manager.beatCode = http.StatusNotFound
+
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	b := newTestBootstrapper(t, server.URL, Config{})
+
+	if err := b.Heartbeat(); !errors.Is(err, ErrUnknownNode) {
+		t.Fatalf("heartbeat returned %v, want ErrUnknownNode", err)
+	}
+}
+
+func TestJoinRejectsUnpinnedKey(t *testing.T) {
+	manager := newTopologyManager(t)
+	server := httptest.NewServer(manager)
+	defer server.Close()
+
+	other := newKey(t)
+	pin := hex.EncodeToString(keys.ConvertECDSAPublicKeyToBytes(&other.PublicKey))
+
+	b := newTestBootstrapper(t, server.URL, Config{MaxAttempts: 1, PinnedServerKey: pin})
+
+	if _, err := b.join(); !errors.Is(err, keys.ErrPinMismatch) {
+		t.Fatalf("join returned %v, want ErrPinMismatch", err)
+	}
+
+	if _, err := b.Join(); err == nil {
+		t.Fatal("join accepted a topology manager key that is not the pinned one")
+	}
+
+	pinned := hex.EncodeToString(keys.ConvertECDSAPublicKeyToBytes(&manager.key.PublicKey))
+	b = newTestBootstrapper(t, server.URL, Config{MaxAttempts: 1, PinnedServerKey: pinned})
+
+	if _, err := b.Join(); err != nil {
+		t.Fatalf("join with the right pinned key failed: %v", err)
+	}
+}
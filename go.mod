@@ -3,13 +3,14 @@ module mqtt-fed
 go 1.18
 
 require (
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/hashicorp/golang-lru v1.0.2
+	github.com/sandipmavani/hardwareid v0.0.0-20190923123414-c3f8f1d75c38
 )
 
 require (
 	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/sandipmavani/hardwareid v0.0.0-20190923123414-c3f8f1d75c38
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 )
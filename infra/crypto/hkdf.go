@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Labels used as HKDF info prefixes, each purpose gets its own
+// label so a key derived for one use is never reused for another
+const (
+	CONTROL_PLANE_LABEL    = "mqtt-fed/v1/control-plane"
+	TOPIC_ENCRYPTION_LABEL = "mqtt-fed/v1/topic-encryption/"
+	TOPIC_MAC_LABEL        = "mqtt-fed/v1/topic-mac/"
+	SALT_LABEL             = "mqtt-fed/v1/salt"
+	TOPIC_SALT_LABEL       = "mqtt-fed/v1/topic-salt"
+)
+
+// KeySchedule holds the pseudorandom key extracted from one
+// ECDH secret and the identities of both ends of the exchange,
+// every key handed out by it is bound to those identities
+type KeySchedule struct {
+	prk      []byte
+	identity []byte
+}
+
+// GenerateRawSharedSecret returns the ECDH x coordinate, left padded
+// to the curve size, without hashing it. It is meant to be used as
+// HKDF input keying material and never directly as a key
+func GenerateRawSharedSecret(privateKey *ecdsa.PrivateKey, otherPublicKey *ecdsa.PublicKey) ([]byte, error) {
+	if !privateKey.Curve.IsOnCurve(otherPublicKey.X, otherPublicKey.Y) {
+		return nil, errors.New("public key is not on the curve")
+	}
+
+	x, _ := privateKey.Curve.ScalarMult(otherPublicKey.X, otherPublicKey.Y, privateKey.D.Bytes())
+
+	size := (privateKey.Curve.Params().BitSize + 7) / 8
+	secret := make([]byte, size)
+	x.FillBytes(secret)
+
+	return secret, nil
+}
+
+// HKDFExtract implements the extract step of RFC 5869 with SHA-256
+func HKDFExtract(salt, secret []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+
+	return mac.Sum(nil)
+}
+
+// HKDFExpand implements the expand step of RFC 5869 with SHA-256
+// length can be at most 255 times the hash size
+func HKDFExpand(prk, info []byte, length int) ([]byte, error) {
+	if length > 255*sha256.Size {
+		return nil, errors.New("hkdf: requested key is too long")
+	}
+
+	okm := make([]byte, 0, length)
+	var block []byte
+
+	for counter := byte(1); len(okm) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		block = mac.Sum(nil)
+
+		okm = append(okm, block...)
+	}
+
+	return okm[:length], nil
+}
+
+// NewKeySchedule extracts a pseudorandom key from the ECDH secret.
+// The identities are sorted before being mixed into the salt so both
+// ends derive the same keys regardless of who is local and who is remote
+func NewKeySchedule(secret, localIdentity, remoteIdentity []byte) *KeySchedule {
+	first, second := localIdentity, remoteIdentity
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	identity := lengthPrefixed(first, second)
+	salt := append([]byte(SALT_LABEL), identity...)
+
+	return &KeySchedule{
+		prk:      HKDFExtract(salt, secret),
+		identity: identity,
+	}
+}
+
+// Derive expands a key of the given length for the given label,
+// the identities of both ends are always part of the info string
+func (k *KeySchedule) Derive(label string, length int) ([]byte, error) {
+	info := append([]byte(label), k.identity...)
+
+	return HKDFExpand(k.prk, info, length)
+}
+
+// ControlPlaneKey returns the AES-256 key used for the GCM encrypted
+// messages exchanged with the topology manager
+func (k *KeySchedule) ControlPlaneKey() []byte {
+	key, _ := k.Derive(CONTROL_PLANE_LABEL, 32)
+	return key
+}
+
+// TopicKeys derives the AES-256 key and the SipHash key of a federated
+// topic from its session key, the topic is part of both info strings
+// so the same session key never gives the same keys on two topics
+func TopicKeys(sessionKey []byte, topic string) ([]byte, [16]byte) {
+	prk := HKDFExtract([]byte(TOPIC_SALT_LABEL), sessionKey)
+
+	encryptionKey, _ := HKDFExpand(prk, []byte(TOPIC_ENCRYPTION_LABEL+topic), 32)
+
+	var macKey [16]byte
+	key, _ := HKDFExpand(prk, []byte(TOPIC_MAC_LABEL+topic), len(macKey))
+	copy(macKey[:], key)
+
+	return encryptionKey, macKey
+}
+
+// lengthPrefixed concatenates the values with a two byte length
+// in front of each one, so different splits never collide
+func lengthPrefixed(values ...[]byte) []byte {
+	var out []byte
+
+	for _, value := range values {
+		out = append(out, byte(len(value)>>8), byte(len(value)))
+		out = append(out, value...)
+	}
+
+	return out
+}
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// sequence returns the bytes from..to-1, the inputs of the RFC 5869 vectors
+func sequence(from, to int) []byte {
+	out := make([]byte, 0, to-from)
+
+	for b := from; b < to; b++ {
+		out = append(out, byte(b))
+	}
+
+	return out
+}
+
+func unhex(t *testing.T, value string) []byte {
+	t.Helper()
+
+	out, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return out
+}
+
+// TestHKDFVectors checks the SHA-256 test cases of RFC 5869 appendix A
+func TestHKDFVectors(t *testing.T) {
+	cases := []struct {
+		name   string
+		ikm    []byte
+		salt   []byte
+		info   []byte
+		length int
+		prk    string
+		okm    string
+	}{
+		{
+			name:   "A.1 basic",
+			ikm:    bytes.Repeat([]byte{0x0b}, 22),
+			salt:   sequence(0x00, 0x0d),
+			info:   sequence(0xf0, 0xfa),
+			length: 42,
+			prk:    "077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5",
+			okm:    "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+		},
+		{
+			name:   "A.2 longer inputs",
+			ikm:    sequence(0x00, 0x50),
+			salt:   sequence(0x60, 0xb0),
+			info:   sequence(0xb0, 0x100),
+			length: 82,
+			prk:    "06a6b88c5853361a06104c9ceb35b45cef760014904671014a193f40c15fc244",
+			okm: "b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c" +
+				"59045a99cac7827271cb41c65e590e09da3275600c2f09b8367793a9aca3db71" +
+				"cc30c58179ec3e87c14c01d5c1f3434f1d87",
+		},
+		{
+			name:   "A.3 zero length salt and info",
+			ikm:    bytes.Repeat([]byte{0x0b}, 22),
+			length: 42,
+			prk:    "19ef24a32c717b167f33a91d6f648bdf96596776afdb6377ac434c1c293ccb04",
+			okm:    "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			prk := HKDFExtract(c.salt, c.ikm)
+			if !bytes.Equal(prk, unhex(t, c.prk)) {
+				t.Fatalf("prk = %x, want %s", prk, c.prk)
+			}
+
+			okm, err := HKDFExpand(prk, c.info, c.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(okm, unhex(t, c.okm)) {
+				t.Fatalf("okm = %x, want %s", okm, c.okm)
+			}
+		})
+	}
+}
+
+func TestHKDFExpandTooLong(t *testing.T) {
+	if _, err := HKDFExpand(make([]byte, 32), nil, 255*32+1); err == nil {
+		t.Fatal("expected an error for a key longer than 255 blocks")
+	}
+}
+
+// TestTopicKeys checks that the encryption and MAC keys never share bytes
+// and that every topic gets its own keys from the same session key
+func TestTopicKeys(t *testing.T) {
+	sessionKey := []byte("0123456789abcdef0123456789abcdef")
+
+	encryptionKey, macKey := TopicKeys(sessionKey, "sensors/temp")
+
+	if len(encryptionKey) != 32 {
+		t.Fatalf("encryption key has %d bytes, want 32", len(encryptionKey))
+	}
+
+	if bytes.Equal(encryptionKey[:16], macKey[:]) || bytes.Equal(encryptionKey[:16], sessionKey[:16]) {
+		t.Fatal("the MAC key or the session key is reused as the encryption key")
+	}
+
+	otherEncryptionKey, otherMacKey := TopicKeys(sessionKey, "sensors/humidity")
+
+	if bytes.Equal(encryptionKey, otherEncryptionKey) || macKey == otherMacKey {
+		t.Fatal("two topics derived the same keys")
+	}
+
+	againEncryptionKey, againMacKey := TopicKeys(sessionKey, "sensors/temp")
+
+	if !bytes.Equal(encryptionKey, againEncryptionKey) || macKey != againMacKey {
+		t.Fatal("the derivation is not deterministic")
+	}
+}
+
+// TestKeyScheduleSymmetric checks that both ends of an exchange derive
+// the same control plane key whatever side they are on
+func TestKeyScheduleSymmetric(t *testing.T) {
+	secret := sequence(0, 32)
+
+	local := NewKeySchedule(secret, []byte("federator-1"), []byte("topology-manager"))
+	remote := NewKeySchedule(secret, []byte("topology-manager"), []byte("federator-1"))
+
+	if !bytes.Equal(local.ControlPlaneKey(), remote.ControlPlaneKey()) {
+		t.Fatal("the two ends derived different control plane keys")
+	}
+
+	other := NewKeySchedule(secret, []byte("federator-2"), []byte("topology-manager"))
+
+	if bytes.Equal(local.ControlPlaneKey(), other.ControlPlaneKey()) {
+		t.Fatal("the identities are not bound to the derived key")
+	}
+}
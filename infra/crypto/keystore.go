@@ -0,0 +1,283 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const IDENTITY_FILE = "identity.pem"
+
+const PLAIN_KEY_BLOCK = "EC PRIVATE KEY"
+const ENCRYPTED_KEY_BLOCK = "MQTT-FED ENCRYPTED PRIVATE KEY"
+
+// PBKDF2_ITERATIONS is the work factor used to stretch the passphrase
+const PBKDF2_ITERATIONS = 210000
+
+// ErrIdentityNotFound is returned when the key store has no identity yet
+var ErrIdentityNotFound = errors.New("identity not found in key store")
+
+// ErrWrongPassphrase is returned when the stored key cannot be decrypted
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted identity")
+
+// Identity is the long term identity of a federator,
+// the node id it presents to the topology manager
+// and the key pair used in the key exchanges
+type Identity struct {
+	NodeId     string
+	PrivateKey *ecdsa.PrivateKey
+}
+
+// KeyStore is an interface that
+// defines where a federator keeps its identity
+// between restarts
+type KeyStore interface {
+	Load() (*Identity, error)
+	Save(identity *Identity) error
+}
+
+// FileKeyStore keeps the identity as a PEM file inside Dir,
+// when Passphrase is set the private key is encrypted with
+// AES-GCM under a PBKDF2 derived key
+type FileKeyStore struct {
+	Dir        string
+	Passphrase []byte
+}
+
+// NewFileKeyStore creates a new FileKeyStore instance
+func NewFileKeyStore(dir string, passphrase []byte) *FileKeyStore {
+	return &FileKeyStore{
+		Dir:        dir,
+		Passphrase: passphrase,
+	}
+}
+
+// NewIdentity creates a new identity with a fresh key pair,
+// if nodeId is empty a random one is generated
+func NewIdentity(nodeId string) (*Identity, error) {
+	privateKey, _, err := GenerateECDHKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if nodeId == "" {
+		random := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, random); err != nil {
+			return nil, err
+		}
+
+		nodeId = hex.EncodeToString(random)
+	}
+
+	return &Identity{
+		NodeId:     nodeId,
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// Path returns the path of the identity file
+func (s FileKeyStore) Path() string {
+	return filepath.Join(s.Dir, IDENTITY_FILE)
+}
+
+// Load reads the identity from disk
+// returns ErrIdentityNotFound if it was never provisioned
+func (s FileKeyStore) Load() (*Identity, error) {
+	data, err := os.ReadFile(s.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrIdentityNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("identity file is not PEM encoded")
+	}
+
+	der := block.Bytes
+
+	if block.Type == ENCRYPTED_KEY_BLOCK {
+		if len(s.Passphrase) == 0 {
+			return nil, errors.New("identity is encrypted but no passphrase was given")
+		}
+
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, err
+		}
+
+		iterations, err := strconv.Atoi(block.Headers["Iterations"])
+		if err != nil {
+			return nil, err
+		}
+
+		der, err = openWithPassphrase(block.Bytes, s.Passphrase, salt, iterations)
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+	} else if block.Type != PLAIN_KEY_BLOCK {
+		return nil, errors.New("unexpected PEM block " + block.Type)
+	}
+
+	privateKey, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		NodeId:     block.Headers["Node-Id"],
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// Save writes the identity to disk, readable only by the owner
+func (s FileKeyStore) Save(identity *Identity) error {
+	der, err := x509.MarshalECPrivateKey(identity.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	block := &pem.Block{
+		Type:    PLAIN_KEY_BLOCK,
+		Headers: map[string]string{"Node-Id": identity.NodeId},
+		Bytes:   der,
+	}
+
+	if len(s.Passphrase) > 0 {
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return err
+		}
+
+		sealed, err := sealWithPassphrase(der, s.Passphrase, salt, PBKDF2_ITERATIONS)
+		if err != nil {
+			return err
+		}
+
+		block.Type = ENCRYPTED_KEY_BLOCK
+		block.Headers["Salt"] = hex.EncodeToString(salt)
+		block.Headers["Iterations"] = strconv.Itoa(PBKDF2_ITERATIONS)
+		block.Bytes = sealed
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves half an identity
+	tmp := s.Path() + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.Path())
+}
+
+// LoadOrCreate loads the identity from the store and, if there is none,
+// creates one with the given node id and saves it
+func LoadOrCreate(store KeyStore, nodeId string) (*Identity, error) {
+	identity, err := store.Load()
+
+	if errors.Is(err, ErrIdentityNotFound) {
+		identity, err = NewIdentity(nodeId)
+		if err != nil {
+			return nil, err
+		}
+
+		err = store.Save(identity)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// sealWithPassphrase encrypts the plaintext with a key stretched from the passphrase
+func sealWithPassphrase(plaintext, passphrase, salt []byte, iterations int) ([]byte, error) {
+	gcm, err := passphraseCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, salt), nil
+}
+
+// openWithPassphrase decrypts a value sealed by sealWithPassphrase
+func openWithPassphrase(ciphertext, passphrase, salt []byte, iterations int) ([]byte, error) {
+	gcm, err := passphraseCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, salt)
+}
+
+func passphraseCipher(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(passphrase, salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2 implements PBKDF2 from RFC 8018 with HMAC over the given hash,
+// the key store always uses SHA-256
+func pbkdf2(password, salt []byte, iterations, length int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	key := make([]byte, 0, length)
+	counter := make([]byte, 4)
+
+	for blockIndex := uint32(1); len(key) < length; blockIndex++ {
+		binary.BigEndian.PutUint32(counter, blockIndex)
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:length]
+}
@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"testing"
+)
+
+// TestPBKDF2Vectors checks the HMAC-SHA1 vectors of RFC 6070 and the
+// HMAC-SHA256 vectors of RFC 7914 section 11
+func TestPBKDF2Vectors(t *testing.T) {
+	cases := []struct {
+		name       string
+		hash       func() hash.Hash
+		password   string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"RFC 6070 c=1", sha1.New, "password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"RFC 6070 c=2", sha1.New, "password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"RFC 6070 c=4096", sha1.New, "password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{
+			"RFC 6070 long", sha1.New, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038",
+		},
+		{"RFC 6070 nul", sha1.New, "pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+		{
+			"RFC 7914 c=1", sha256.New, "passwd", "salt", 1,
+			"55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+				"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783",
+		},
+		{
+			"RFC 7914 c=80000", sha256.New, "Password", "NaCl", 80000,
+			"4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56" +
+				"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			want := unhex(t, c.key)
+			key := pbkdf2([]byte(c.password), []byte(c.salt), c.iterations, len(want), c.hash)
+
+			if !bytes.Equal(key, want) {
+				t.Fatalf("key = %x, want %s", key, c.key)
+			}
+		})
+	}
+}
+
+func TestFileKeyStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileKeyStore(dir, []byte("secret passphrase"))
+
+	created, err := LoadOrCreate(store, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadOrCreate(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.NodeId != "node-1" || !loaded.PrivateKey.Equal(created.PrivateKey) {
+		t.Fatal("the stored identity was not loaded back")
+	}
+
+	wrong := NewFileKeyStore(dir, []byte("other passphrase"))
+
+	if _, err := wrong.Load(); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("load with a wrong passphrase returned %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the peer presents a certificate
+// or a key that does not match the configured pin
+var ErrPinMismatch = errors.New("peer identity does not match the pinned value")
+
+// NewPinnedTLSConfig creates a TLS configuration that trusts the CA bundle
+// in caFile (system roots when empty) and, when pins are given, only accepts
+// chains containing a certificate whose SubjectPublicKeyInfo SHA-256 is pinned.
+// Pins are hex encoded, separated by commas
+func NewPinnedTLSConfig(caFile string, pins string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	var pinned [][]byte
+	for _, pin := range strings.Split(pins, ",") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(pin)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, errors.New("invalid certificate pin " + pin)
+		}
+
+		pinned = append(pinned, decoded)
+	}
+
+	if len(pinned) > 0 {
+		// runs after the normal chain verification, so the pin
+		// narrows what the CA accepts and never widens it
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					fingerprint := SPKIFingerprint(cert)
+
+					for _, pin := range pinned {
+						if subtle.ConstantTimeCompare(fingerprint, pin) == 1 {
+							return nil
+						}
+					}
+				}
+			}
+
+			return ErrPinMismatch
+		}
+	}
+
+	return config, nil
+}
+
+// SPKIFingerprint returns the SHA-256 of the certificate SubjectPublicKeyInfo
+func SPKIFingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// CheckPinnedKey compares a received public key with a hex encoded pin,
+// an empty pin accepts any key
+func CheckPinnedKey(pin string, received []byte) error {
+	if pin == "" {
+		return nil
+	}
+
+	expected, err := hex.DecodeString(strings.TrimSpace(pin))
+	if err != nil {
+		return err
+	}
+
+	if !CheckKeys(expected, received) {
+		return ErrPinMismatch
+	}
+
+	return nil
+}
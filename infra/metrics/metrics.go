@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry is a struct that
+// keeps named counters and duration
+// observations of a federator
+type Registry struct {
+	mu        sync.Mutex
+	counters  map[string]int64
+	durations map[string]*Duration
+}
+
+// Duration is a struct that
+// summarizes the observations of a duration
+type Duration struct {
+	Count int64         `json:"count"`
+	Total time.Duration `json:"total"`
+	Min   time.Duration `json:"min"`
+	Max   time.Duration `json:"max"`
+	Last  time.Duration `json:"last"`
+}
+
+// Snapshot is a copy of the registry values at some point in time
+type Snapshot struct {
+	Counters  map[string]int64    `json:"counters"`
+	Durations map[string]Duration `json:"durations"`
+}
+
+// NewRegistry creates a new Registry instance
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:  make(map[string]int64),
+		durations: make(map[string]*Duration),
+	}
+}
+
+// Inc adds one to a counter
+func (r *Registry) Inc(name string) {
+	r.Add(name, 1)
+}
+
+// Add adds a value to a counter, the counter is created on first use
+func (r *Registry) Add(name string, value int64) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.counters[name] += value
+}
+
+// Observe records a duration
+func (r *Registry) Observe(name string, value time.Duration) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.durations[name]
+	if !ok {
+		d = &Duration{Min: value}
+		r.durations[name] = d
+	}
+
+	d.Count += 1
+	d.Total += value
+	d.Last = value
+
+	if value < d.Min {
+		d.Min = value
+	}
+	if value > d.Max {
+		d.Max = value
+	}
+}
+
+// Counter returns the current value of a counter
+func (r *Registry) Counter(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counters[name]
+}
+
+// Snapshot copies the current values
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := Snapshot{
+		Counters:  make(map[string]int64, len(r.counters)),
+		Durations: make(map[string]Duration, len(r.durations)),
+	}
+
+	for name, value := range r.counters {
+		snapshot.Counters[name] = value
+	}
+
+	for name, value := range r.durations {
+		snapshot.Durations[name] = *value
+	}
+
+	return snapshot
+}
+
+// Print writes every value to stdout, sorted by name
+func (r *Registry) Print() {
+	snapshot := r.Snapshot()
+
+	var names []string
+	for name := range snapshot.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println("metric", name, snapshot.Counters[name])
+	}
+
+	names = names[:0]
+	for name := range snapshot.Durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := snapshot.Durations[name]
+		fmt.Println("metric", name, "count", d.Count, "min", d.Min, "max", d.Max, "last", d.Last)
+	}
+}
+
+// ServeHTTP writes the snapshot as JSON so the registry
+// can be mounted on any HTTP server
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Snapshot())
+}
@@ -2,62 +2,164 @@ package queue
 
 import (
 	"fmt"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+const MQTT_V3 = 3
+const MQTT_V5 = 5
+
 type Client struct {
 	ClientID string
 	ClientIP string
-	client   mqtt.Client
+	Version  int
+	conn     connection
+	outbox   *outbox // publications sent by PublishAsync
+	events   *linkEvents
+}
+
+// linkEvents keeps the handler called when the
+// connection of a client to its broker is lost
+type linkEvents struct {
+	mu     sync.Mutex
+	onLost func(err error)
+}
+
+func (e *linkEvents) lost(err error) {
+	e.mu.Lock()
+	onLost := e.onLost
+	e.mu.Unlock()
+
+	if onLost != nil {
+		onLost(err)
+	}
+}
+
+// subscriptions keeps the topics a connection subscribed to, the broker
+// forgets them with the clean session so they are subscribed again
+// every time the connection comes back
+type subscriptions struct {
+	mu     sync.Mutex
+	topics map[string]subscription
+}
+
+type subscription struct {
+	qos     byte
+	live    bool // only live publications, see ConsumeLive
+	handler MessageHandler
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{topics: make(map[string]subscription)}
 }
 
-// NewClient creates a new MQTT client
+func (s *subscriptions) add(topics map[string]byte, live bool, handler MessageHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic, qos := range topics {
+		s.topics[topic] = subscription{qos: qos, live: live, handler: handler}
+	}
+}
+
+// all returns a copy of the subscriptions, safe to use without the lock
+func (s *subscriptions) all() map[string]subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topics := make(map[string]subscription, len(s.topics))
+	for topic, sub := range s.topics {
+		topics[topic] = sub
+	}
+
+	return topics
+}
+
+// connection is an interface that
+// defines what the client needs from
+// an MQTT 3 or MQTT 5 link
+type connection interface {
+	subscribe(topics map[string]byte, live bool, handler MessageHandler) error
+	publish(topic string, payload []byte, qos byte, retained bool, props *Properties) error
+	disconnect()
+}
+
+// NewClient creates a new MQTT 3 client
 // broker: the MQTT broker URL
 // clientID: the client ID
 // returns a new MQTT client
 func NewClient(broker string, clientID string) (*Client, error) {
-	fmt.Println("Creating new client with broker: ", broker, " and client ID: ", clientID)
+	return NewClientVersion(broker, clientID, MQTT_V3)
+}
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	client := mqtt.NewClient(opts)
+// NewClientVersion creates a new MQTT client
+// broker: the MQTT broker URL
+// clientID: the client ID
+// version: MQTT_V3 or MQTT_V5
+// returns a new MQTT client
+func NewClientVersion(broker string, clientID string, version int) (*Client, error) {
+	fmt.Println("Creating new client with broker: ", broker, " and client ID: ", clientID, " MQTT version: ", version)
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	var conn connection
+	var err error
+
+	events := &linkEvents{}
+
+	if version == MQTT_V5 {
+		conn, err = newMQTT5Connection(broker, clientID, events.lost)
+	} else {
+		version = MQTT_V3
+		conn, err = newMQTT3Connection(broker, clientID, events.lost)
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	return &Client{
 		ClientID: clientID,
 		ClientIP: broker,
-		client:   client,
+		Version:  version,
+		conn:     conn,
+		events:   events,
 	}, nil
 }
 
+// OnConnectionLost sets the handler called when the connection
+// to the broker is lost, it is called from the client goroutine
+func (c Client) OnConnectionLost(handler func(err error)) {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+
+	c.events.onLost = handler
+}
+
 // Consume subscribes to a list of topics
 // topics: a map of topics to subscribe to
 // messageHandler: the message handler
 // returns a boolean indicating if the subscription was successful and an error
-func (c Client) Consume(topics map[string]byte, messageHandler mqtt.MessageHandler) (bool, error) {
+func (c Client) Consume(topics map[string]byte, messageHandler MessageHandler) (bool, error) {
 	fmt.Println("Subscribing to topics: ", topics)
 
-	if !c.client.IsConnectionOpen() {
-		c.client.Connect()
-
-		token := c.client.Connect()
-		token.Wait()
-		if token.Error() != nil {
-			panic(token.Error())
-		}
-
+	if err := c.conn.subscribe(topics, false, messageHandler); err != nil {
+		return false, err
 	}
 
-	token := c.client.SubscribeMultiple(topics, messageHandler)
-	token.Wait()
+	return true, nil
+}
 
-	if token.Error() != nil {
-		return false, token.Error()
+// ConsumeLive subscribes to a list of topics without the retained
+// messages the broker replays at subscribe time. On MQTT 5 links the
+// retain flag is kept as published (RetainAsPublished), on MQTT 3 links
+// the broker clears it on live deliveries (MQTT 3.1.1 3.3.1.3) so it is
+// always false and a retained publish can not be told from a plain one
+// returns a boolean indicating if the subscription was successful and an error
+func (c Client) ConsumeLive(topics map[string]byte, messageHandler MessageHandler) (bool, error) {
+	fmt.Println("Subscribing to the live messages of topics: ", topics)
+
+	if err := c.conn.subscribe(topics, true, messageHandler); err != nil {
+		return false, err
 	}
 
 	return true, nil
@@ -70,20 +172,111 @@ func (c Client) Consume(topics map[string]byte, messageHandler mqtt.MessageHandl
 // retained: whether the message should be retained
 // returns a boolean indicating if the publication was successful and an error
 func (c Client) Publish(topic string, message string, qos byte, retained bool) (bool, error) {
-	fmt.Println("Publishing to topic: ", topic, " as ", c.ClientIP, " with message: ", message)
+	return c.PublishWithProperties(topic, []byte(message), qos, retained, nil)
+}
 
-	token := c.client.Publish(topic, qos, retained, message)
-	token.Wait()
+// PublishWithProperties publishes a message with MQTT 5 properties,
+// on MQTT 3 links the properties are dropped
+// returns a boolean indicating if the publication was successful and an error
+func (c Client) PublishWithProperties(topic string, payload []byte, qos byte, retained bool, props *Properties) (bool, error) {
+	fmt.Println("Publishing to topic: ", topic, " as ", c.ClientIP, " with message: ", string(payload))
 
-	if token.Error() != nil {
-		return false, token.Error()
+	if err := c.conn.publish(topic, payload, qos, retained, props); err != nil {
+		return false, err
 	}
 
 	return true, nil
 }
 
 // Disconnect disconnects the client
-// the 10 ms timeout is hardcoded
 func (c Client) Disconnect() {
+	if c.outbox != nil {
+		c.outbox.close()
+	}
+
+	c.conn.disconnect()
+}
+
+// mqtt3Connection is a connection to a broker using the paho MQTT 3 client,
+// paho reconnects it on its own and the topics are subscribed again
+type mqtt3Connection struct {
+	client     mqtt.Client
+	subscribed *subscriptions
+}
+
+func newMQTT3Connection(broker string, clientID string, onLost func(err error)) (*mqtt3Connection, error) {
+	c := &mqtt3Connection{subscribed: newSubscriptions()}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		fmt.Println("Connection to", broker, "lost:", err)
+		onLost(err)
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		for topic, sub := range c.subscribed.all() {
+			client.Subscribe(topic, sub.qos, mqtt3Handler(sub.live, sub.handler))
+		}
+	})
+	c.client = mqtt.NewClient(opts)
+
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	return c, nil
+}
+
+// mqtt3Handler adapts a MessageHandler to the paho MQTT 3 callback. MQTT 3
+// has no retain handling, but only the replays sent at subscribe time keep
+// the retain flag, so the live subscriptions drop the retained messages
+func mqtt3Handler(live bool, handler MessageHandler) mqtt.MessageHandler {
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		if live && msg.Retained() {
+			return
+		}
+
+		handler(mqtt3Message{msg})
+	}
+}
+
+func (c *mqtt3Connection) subscribe(topics map[string]byte, live bool, handler MessageHandler) error {
+	if !c.client.IsConnectionOpen() {
+		c.client.Connect()
+
+		token := c.client.Connect()
+		token.Wait()
+		if token.Error() != nil {
+			panic(token.Error())
+		}
+
+	}
+
+	c.subscribed.add(topics, live, handler)
+
+	token := c.client.SubscribeMultiple(topics, mqtt3Handler(live, handler))
+	token.Wait()
+
+	return token.Error()
+}
+
+func (c *mqtt3Connection) publish(topic string, payload []byte, qos byte, retained bool, _ *Properties) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	token.Wait()
+
+	return token.Error()
+}
+
+// disconnect the 10 ms timeout is hardcoded
+func (c *mqtt3Connection) disconnect() {
 	c.client.Disconnect(10)
 }
+
+// mqtt3Message adapts a paho MQTT 3 message to a Message
+type mqtt3Message struct {
+	mqtt.Message
+}
+
+func (m mqtt3Message) Properties() *Properties { return nil }
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt3TestMessage is a received MQTT 3 message
+type mqtt3TestMessage struct {
+	topic    string
+	retained bool
+}
+
+func (m mqtt3TestMessage) Duplicate() bool   { return false }
+func (m mqtt3TestMessage) Qos() byte         { return 1 }
+func (m mqtt3TestMessage) Retained() bool    { return m.retained }
+func (m mqtt3TestMessage) Topic() string     { return m.topic }
+func (m mqtt3TestMessage) MessageID() uint16 { return 1 }
+func (m mqtt3TestMessage) Payload() []byte   { return []byte("22.5") }
+func (m mqtt3TestMessage) Ack()              {}
+
+var _ mqtt.Message = mqtt3TestMessage{}
+
+func TestLiveSubscribeOptions(t *testing.T) {
+	live := subscribeOptions(2, true)
+
+	if !live.RetainAsPublished {
+		t.Fatal("live subscription clears the retain flag of the live publishes")
+	}
+
+	if live.RetainHandling != RETAIN_HANDLING_NONE {
+		t.Fatalf("live subscription has retain handling %d, want %d", live.RetainHandling, RETAIN_HANDLING_NONE)
+	}
+
+	if live.QoS != 2 {
+		t.Fatalf("live subscription has QoS %d, want 2", live.QoS)
+	}
+
+	// the federation topics need the retained core anns replayed
+	plain := subscribeOptions(1, false)
+
+	if plain.RetainAsPublished || plain.RetainHandling != 0 || plain.QoS != 1 {
+		t.Fatalf("plain subscription options %+v", plain)
+	}
+}
+
+func TestMQTT3LiveHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     bool
+		retained bool
+		handled  bool
+	}{
+		{"live publish on a live subscription", true, false, true},
+		{"replay on a live subscription", true, true, false},
+		{"live publish on a plain subscription", false, false, true},
+		{"replay on a plain subscription", false, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handled := false
+
+			handler := mqtt3Handler(test.live, func(msg Message) {
+				handled = true
+
+				if msg.Retained() != test.retained {
+					t.Fatalf("retain flag %v, want %v", msg.Retained(), test.retained)
+				}
+			})
+
+			handler(nil, mqtt3TestMessage{topic: "federated/sensors/temp", retained: test.retained})
+
+			if handled != test.handled {
+				t.Fatalf("handled %v, want %v", handled, test.handled)
+			}
+		})
+	}
+}
+
+func TestSubscriptionsKeepLive(t *testing.T) {
+	subscribed := newSubscriptions()
+	subscribed.add(map[string]byte{"federator/core_ann/#": 2}, false, func(Message) {})
+	subscribed.add(map[string]byte{"federated/#": 2}, true, func(Message) {})
+
+	all := subscribed.all()
+
+	// a reconnect subscribes again with the same options
+	if !all["federated/#"].live || all["federator/core_ann/#"].live {
+		t.Fatalf("subscriptions %+v", all)
+	}
+}
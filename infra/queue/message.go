@@ -0,0 +1,42 @@
+package queue
+
+// Message is an interface that
+// defines a message received from a broker,
+// independent of the MQTT version of the link
+type Message interface {
+	Topic() string
+	Payload() []byte
+	Qos() byte
+	Retained() bool
+	Properties() *Properties // nil on MQTT 3 links
+}
+
+// MessageHandler is called for every message received
+// on the topics given to Consume
+type MessageHandler func(msg Message)
+
+// Properties is a struct that
+// defines the MQTT 5 publish properties carried
+// across the federation, it is nil when the
+// publisher used MQTT 3
+type Properties struct {
+	ContentType     string         `json:",omitempty"`
+	ResponseTopic   string         `json:",omitempty"`
+	CorrelationData []byte         `json:",omitempty"`
+	MessageExpiry   *uint32        `json:",omitempty"` // seconds
+	PayloadFormat   *byte          `json:",omitempty"`
+	User            []UserProperty `json:",omitempty"`
+}
+
+// UserProperty is a key value pair set by the publisher,
+// a list is used because keys can repeat and order matters
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// IsEmpty checks if none of the properties is set
+func (p *Properties) IsEmpty() bool {
+	return p == nil || (p.ContentType == "" && p.ResponseTopic == "" && len(p.CorrelationData) == 0 &&
+		p.MessageExpiry == nil && p.PayloadFormat == nil && len(p.User) == 0)
+}
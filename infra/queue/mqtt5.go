@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho "github.com/eclipse/paho.golang/paho"
+)
+
+// RECONNECT_DELAY is the wait between two attempts to connect an MQTT 5 link
+const RECONNECT_DELAY = 5 * time.Second
+
+// mqtt5Connection is a connection to a broker using MQTT 5,
+// publish properties are kept end to end on this path.
+// autopaho reconnects it and the topics are subscribed again
+type mqtt5Connection struct {
+	manager    *autopaho.ConnectionManager
+	router     *paho.SingleHandlerRouter
+	subscribed *subscriptions
+}
+
+// newMQTT5Connection connects to the broker, it waits for the
+// first connection so a broker that is down is reported right away
+func newMQTT5Connection(broker string, clientID string, onLost func(err error)) (*mqtt5Connection, error) {
+	address, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqtt5Connection{
+		router:     paho.NewSingleHandlerRouter(nil),
+		subscribed: newSubscriptions(),
+	}
+
+	manager, err := autopaho.NewConnection(context.Background(), autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{address},
+		KeepAlive:         30,
+		ConnectRetryDelay: RECONNECT_DELAY,
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, _ *paho.Connack) {
+			c.resubscribe(manager)
+		},
+		OnConnectError: func(err error) {
+			fmt.Println("MQTT 5 connection to", broker, "failed:", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			Router:   c.router,
+			OnClientError: func(err error) {
+				fmt.Println("MQTT 5 client error on", broker, ":", err)
+				onLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				fmt.Println("MQTT 5 broker", broker, "disconnected with reason", d.ReasonCode)
+				onLost(fmt.Errorf("disconnected by the broker with reason %d", d.ReasonCode))
+			},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := manager.AwaitConnection(ctx); err != nil {
+		manager.Disconnect(context.Background())
+		return nil, err
+	}
+
+	c.manager = manager
+
+	return c, nil
+}
+
+// resubscribe subscribes again to every topic after the connection came back
+func (c *mqtt5Connection) resubscribe(manager *autopaho.ConnectionManager) {
+	subscribed := c.subscribed.all()
+
+	if len(subscribed) == 0 {
+		return
+	}
+
+	subscriptions := make(map[string]paho.SubscribeOptions)
+	for topic, sub := range subscribed {
+		subscriptions[topic] = subscribeOptions(sub.qos, sub.live)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := manager.Subscribe(ctx, &paho.Subscribe{Subscriptions: subscriptions}); err != nil {
+		fmt.Println("Error subscribing again after reconnecting:", err)
+	}
+}
+
+// RETAIN_HANDLING_NONE asks the broker not to send the retained messages at subscribe time
+const RETAIN_HANDLING_NONE = 2
+
+// subscribeOptions returns the options of a subscription, a live one
+// gets the retain flag as published and no retained replays
+func subscribeOptions(qos byte, live bool) paho.SubscribeOptions {
+	if !live {
+		return paho.SubscribeOptions{QoS: qos}
+	}
+
+	return paho.SubscribeOptions{
+		QoS:               qos,
+		RetainAsPublished: true,
+		RetainHandling:    RETAIN_HANDLING_NONE,
+	}
+}
+
+func (c *mqtt5Connection) subscribe(topics map[string]byte, live bool, handler MessageHandler) error {
+	c.router.RegisterHandler("#", func(p *paho.Publish) {
+		handler(mqtt5Message{p})
+	})
+
+	c.subscribed.add(topics, live, handler)
+
+	subscriptions := make(map[string]paho.SubscribeOptions)
+	for topic, qos := range topics {
+		subscriptions[topic] = subscribeOptions(qos, live)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	suback, err := c.manager.Subscribe(ctx, &paho.Subscribe{Subscriptions: subscriptions})
+
+	// kept in the subscriptions, they are sent when the connection is back
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, reason := range suback.Reasons {
+		if reason >= 0x80 {
+			return errors.New("broker refused a subscription")
+		}
+	}
+
+	return nil
+}
+
+func (c *mqtt5Connection) publish(topic string, payload []byte, qos byte, retained bool, props *Properties) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := c.manager.Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    payload,
+		Properties: toPahoProperties(props),
+	})
+
+	return err
+}
+
+func (c *mqtt5Connection) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c.manager.Disconnect(ctx)
+}
+
+// mqtt5Message adapts a paho MQTT 5 publish to a Message
+type mqtt5Message struct {
+	publish *paho.Publish
+}
+
+func (m mqtt5Message) Topic() string   { return m.publish.Topic }
+func (m mqtt5Message) Payload() []byte { return m.publish.Payload }
+func (m mqtt5Message) Qos() byte       { return m.publish.QoS }
+func (m mqtt5Message) Retained() bool  { return m.publish.Retain }
+
+func (m mqtt5Message) Properties() *Properties {
+	p := m.publish.Properties
+	if p == nil {
+		return nil
+	}
+
+	props := &Properties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		MessageExpiry:   p.MessageExpiry,
+		PayloadFormat:   p.PayloadFormat,
+	}
+
+	for _, user := range p.User {
+		props.User = append(props.User, UserProperty{Key: user.Key, Value: user.Value})
+	}
+
+	if props.IsEmpty() {
+		return nil
+	}
+
+	return props
+}
+
+// toPahoProperties converts the federation properties back to paho ones,
+// topic alias and subscription identifiers are per link and never copied
+func toPahoProperties(props *Properties) *paho.PublishProperties {
+	if props.IsEmpty() {
+		return nil
+	}
+
+	p := &paho.PublishProperties{
+		ContentType:     props.ContentType,
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: props.CorrelationData,
+		MessageExpiry:   props.MessageExpiry,
+		PayloadFormat:   props.PayloadFormat,
+	}
+
+	for _, user := range props.User {
+		p.User.Add(user.Key, user.Value)
+	}
+
+	return p
+}
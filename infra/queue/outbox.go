@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OUTBOX_SIZE is how many publications can wait for a slow link
+const OUTBOX_SIZE = 1024
+
+var ErrOutboxFull = errors.New("outbox is full")
+var ErrOutboxClosed = errors.New("outbox is closed")
+var ErrRateLimited = errors.New("rate limit of the link exceeded")
+
+// Gate decides if a publication can go out on a link, it returns how
+// long the publication must wait and false if it must be dropped
+type Gate func(topic string, payload []byte) (time.Duration, bool)
+
+// LinkStats is a struct that
+// summarizes the publications sent
+// through the outbox of a client
+type LinkStats struct {
+	Queued       int64         `json:"queued"`
+	Sent         int64         `json:"sent"`
+	Failed       int64         `json:"failed"`
+	Dropped      int64         `json:"dropped"`
+	Throttled    int64         `json:"throttled"`
+	LastLatency  time.Duration `json:"lastLatency"`
+	MaxLatency   time.Duration `json:"maxLatency"`
+	TotalLatency time.Duration `json:"totalLatency"`
+}
+
+// outgoing is a publication waiting in the outbox
+type outgoing struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	props    *Properties
+	sendAt   time.Time // when it was queued plus the delay set by the gate
+}
+
+// outbox is a struct that
+// keeps the publications of a client and
+// sends them from its own goroutine, so a
+// slow or dead link only delays itself
+type outbox struct {
+	mu         sync.Mutex
+	closed     bool
+	messages   chan outgoing
+	stats      LinkStats
+	gate       Gate
+	onComplete func(latency time.Duration, err error)
+}
+
+// StartOutbox starts the sender goroutine of the client, every publication
+// goes through gate first (it can be nil). onComplete is called with the
+// time from enqueue, or from the end of the gate delay, to the publish
+// completion (it can be nil)
+func (c *Client) StartOutbox(gate Gate, onComplete func(latency time.Duration, err error)) {
+	if c.outbox != nil {
+		return
+	}
+
+	c.outbox = &outbox{
+		messages:   make(chan outgoing, OUTBOX_SIZE),
+		gate:       gate,
+		onComplete: onComplete,
+	}
+
+	go c.outbox.run(c.conn)
+}
+
+// PublishAsync queues a publication without waiting for the link,
+// returns ErrOutboxFull if the link is too far behind and ErrRateLimited
+// if the gate dropped it, a client without outbox publishes right away
+func (c Client) PublishAsync(topic string, message string, qos byte, retained bool) error {
+	if c.outbox == nil {
+		_, err := c.Publish(topic, message, qos, retained)
+		return err
+	}
+
+	return c.outbox.enqueue(outgoing{
+		topic:    topic,
+		payload:  []byte(message),
+		qos:      qos,
+		retained: retained,
+		sendAt:   time.Now(),
+	})
+}
+
+// Stats returns the statistics of the outbox of the client
+func (c Client) Stats() LinkStats {
+	if c.outbox == nil {
+		return LinkStats{}
+	}
+
+	c.outbox.mu.Lock()
+	defer c.outbox.mu.Unlock()
+
+	stats := c.outbox.stats
+	stats.Queued = int64(len(c.outbox.messages))
+
+	return stats
+}
+
+func (o *outbox) enqueue(message outgoing) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrOutboxClosed
+	}
+
+	// the gate runs on enqueue so a dropped publication is reported to the
+	// caller, a delayed one waits in the outbox and only holds back this link
+	if o.gate != nil {
+		wait, ok := o.gate(message.topic, message.payload)
+
+		if !ok {
+			o.stats.Throttled += 1
+			return ErrRateLimited
+		}
+
+		message.sendAt = message.sendAt.Add(wait)
+	}
+
+	select {
+	case o.messages <- message:
+		return nil
+	default:
+		o.stats.Dropped += 1
+		return ErrOutboxFull
+	}
+}
+
+// run sends the queued publications one by one, so the
+// order of the publications on a link is kept
+func (o *outbox) run(conn connection) {
+	for message := range o.messages {
+		if wait := time.Until(message.sendAt); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		err := conn.publish(message.topic, message.payload, message.qos, message.retained, message.props)
+		latency := time.Since(message.sendAt)
+
+		o.mu.Lock()
+		if err != nil {
+			o.stats.Failed += 1
+		} else {
+			o.stats.Sent += 1
+			o.stats.LastLatency = latency
+			o.stats.TotalLatency += latency
+			if latency > o.stats.MaxLatency {
+				o.stats.MaxLatency = latency
+			}
+		}
+		onComplete := o.onComplete
+		o.mu.Unlock()
+
+		if err != nil {
+			fmt.Println("Error while publishing to topic: ", message.topic, err)
+		}
+
+		if onComplete != nil {
+			onComplete(latency, err)
+		}
+	}
+}
+
+// close stops accepting publications
+// and ends the sender goroutine
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		close(o.messages)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	keys "mqtt-fed/infra/crypto"
+)
+
+// keygen provisions the identity of a federator in a key store,
+// it refuses to replace an existing identity unless -force is given
+// because the topology manager knows the federator by its key
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dir := flags.String("dir", os.Getenv("KEY_STORE_DIR"), "key store directory")
+	nodeId := flags.String("node-id", os.Getenv("NODE_ID"), "node id, random when empty")
+	force := flags.Bool("force", false, "replace an existing identity")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fmt.Println("keygen: -dir or KEY_STORE_DIR is required")
+		os.Exit(2)
+	}
+
+	// the passphrase is only read from the environment so it never shows up in ps
+	store := keys.NewFileKeyStore(*dir, []byte(os.Getenv("KEY_STORE_PASSPHRASE")))
+
+	if _, err := store.Load(); err == nil && !*force {
+		fmt.Println("keygen: identity already exists at", store.Path(), "(use -force to replace it)")
+		os.Exit(1)
+	} else if err != nil && !errors.Is(err, keys.ErrIdentityNotFound) && !*force {
+		fmt.Println("keygen: could not read existing identity:", err)
+		os.Exit(1)
+	}
+
+	identity, err := keys.NewIdentity(*nodeId)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := store.Save(identity); err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Identity written to", store.Path())
+	fmt.Println("Node ID: ", identity.NodeId)
+	fmt.Printf("Public key: %x\n", keys.ConvertECDSAPublicKeyToBytes(&identity.PrivateKey.PublicKey))
+}
@@ -1,93 +1,164 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ecdsa"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"mqtt-fed/application"
+	"mqtt-fed/bootstrap"
 	keys "mqtt-fed/infra/crypto"
-	"net/http"
-	"os"
 
 	"github.com/sandipmavani/hardwareid"
 )
 
 func main() {
-	federatorConfig := getConfig()
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		trace(os.Args[2:])
+		return
+	}
+
+	bootstrapper := newBootstrapper()
+
+	federatorConfig, err := bootstrapper.Join()
+
+	if err != nil {
+		panic(err)
+	}
+
+	federatorConfig.OnUnknownNode = bootstrapper.RequestRejoin
 
-	application.Run(federatorConfig)
+	federator := application.Run(federatorConfig)
 	fmt.Println("Federator", federatorConfig.Id, "started!")
 
+	go bootstrapper.Watch(federator.Reconfigure)
+
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		go serveMetrics(addr, federator)
+	}
+
 	select {}
 }
 
-func getConfig() application.FederatorConfig {
-	var federatorConfig application.FederatorConfig
+// serveMetrics exposes the federator metrics as JSON on /metrics
+// and the outbox statistics of the neighbor links on /links
+func serveMetrics(addr string, federator *application.Federator) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", federator.Ctx.Metrics)
+	mux.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(federator.LinkStats())
+	})
 
-	if os.Getenv("TOPOLOGY_MANAGER_URL") != "" {
+	fmt.Println("Serving metrics on", addr)
 
-		privateKey, publicKey, err := keys.GenerateECDHKeyPair()
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Println("Error serving metrics:", err)
+	}
+}
 
-		if err != nil {
-			panic(err)
-		}
+// newBootstrapper creates the bootstrapper from the environment,
+// TOPOLOGY_MANAGER_URL is the only required variable
+func newBootstrapper() *bootstrap.Bootstrapper {
+	url := os.Getenv("TOPOLOGY_MANAGER_URL")
 
-		id, err := hardwareid.ID()
+	if url == "" {
+		panic("No configuration provided")
+	}
 
-		if err != nil {
-			panic(err)
-		}
+	privateKey, id := loadIdentity()
 
-		fmt.Println("Hardware ID: ", id)
+	fmt.Println("Node ID: ", id)
 
-		body, _ := json.Marshal(&application.JoinRequest{
-			Ip:         os.Getenv("ADVERTISED_LISTENER"),
-			PublicKey:  keys.ConvertECDSAPublicKeyToBytes(publicKey),
-			HardwareId: id,
-		})
-		payload := bytes.NewBuffer(body)
+	client, err := bootstrap.NewHTTPClient(url, os.Getenv("TOPOLOGY_MANAGER_CA"), os.Getenv("TOPOLOGY_MANAGER_CERT_PINS"))
 
-		fmt.Println("Joining the federated network with body: ", payload)
-		resp, err := http.Post(os.Getenv("TOPOLOGY_MANAGER_URL")+"/api/v1/join", "application/json", payload)
+	if err != nil {
+		panic(err)
+	}
 
-		if err != nil {
-			panic(err)
-		}
+	return bootstrap.New(bootstrap.Config{
+		URL:                url,
+		AdvertisedListener: os.Getenv("ADVERTISED_LISTENER"),
+		NodeId:             id,
+		PrivateKey:         privateKey,
+		PinnedServerKey:    os.Getenv("TOPOLOGY_MANAGER_PUBLIC_KEY"),
+		KeyDerivation:      os.Getenv("KEY_DERIVATION"),
+		HTTPClient:         client,
+		Timeout:            durationEnv("TOPOLOGY_MANAGER_TIMEOUT", 10*time.Second),
+		MaxAttempts:        intEnv("JOIN_MAX_ATTEMPTS", 5),
+		CacheFile:          os.Getenv("CONFIG_CACHE_FILE"),
+		HeartbeatInterval:  durationEnv("HEARTBEAT_INTERVAL", 0),
+	})
+}
+
+// durationEnv reads a duration like "10s" from the environment
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// intEnv reads an integer from the environment
+func intEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
 
-		var response application.HTTPResponse
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
 
-		err = json.NewDecoder(resp.Body).Decode(&response)
+// loadIdentity returns the key pair and node id of this federator.
+// With KEY_STORE_DIR set the identity is kept on disk (created on first
+// start), otherwise a new key pair is generated on every start and a
+// config cached by a previous start can not be used.
+// NODE_ID always overrides the stored or hardware based node id
+func loadIdentity() (*ecdsa.PrivateKey, string) {
+	nodeId := os.Getenv("NODE_ID")
+
+	if dir := os.Getenv("KEY_STORE_DIR"); dir != "" {
+		store := keys.NewFileKeyStore(dir, []byte(os.Getenv("KEY_STORE_PASSPHRASE")))
+
+		identity, err := keys.LoadOrCreate(store, nodeId)
 
 		if err != nil {
 			panic(err)
 		}
 
-		if response.Code != 200 {
-			panic(response.Description)
+		if nodeId == "" {
+			nodeId = identity.NodeId
 		}
 
-		dataBytes, _ := json.Marshal(response.Data)
+		return identity.PrivateKey, nodeId
+	}
+
+	privateKey, _, err := keys.GenerateECDHKeyPair()
+
+	if err != nil {
+		panic(err)
+	}
 
-		fmt.Println("Data bytes: ", string(dataBytes))
+	if nodeId == "" {
+		nodeId, err = hardwareid.ID()
 
-		err = json.Unmarshal(dataBytes, &federatorConfig)
 		if err != nil {
 			panic(err)
 		}
-
-		federatorConfig.CoreAnnInterval = time.Duration(federatorConfig.CoreAnnInterval)
-		federatorConfig.BeaconInterval = time.Duration(federatorConfig.BeaconInterval)
-		federatorConfig.PrivateKey = privateKey
-		federatorConfig.PublicKey = publicKey
-
-		serverKey, _ := keys.ConvertBytesToECDSAPublicKey(privateKey, federatorConfig.ServerPublicKey)
-		mySharedKey, _ := keys.GenerateSharedSecret(privateKey, serverKey)
-		federatorConfig.SharedKey = mySharedKey
-	} else {
-		panic("No configuration provided")
 	}
 
-	return federatorConfig
+	return privateKey, nodeId
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt-fed/application"
+	"mqtt-fed/infra/queue"
+)
+
+// trace asks the local federator to trace the mesh of a federated topic
+// and prints the path to every federator that answered before the timeout
+func trace(args []string) {
+	port := os.Getenv("MOSQUITTO_PORT")
+	if port == "" {
+		port = "1883"
+	}
+
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	broker := flags.String("broker", "tcp://localhost:"+port, "broker of the federator starting the trace")
+	topic := flags.String("topic", "", "federated topic to trace")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for replies")
+	flags.Parse(args)
+
+	if *topic == "" {
+		fmt.Println("trace: -topic is required")
+		os.Exit(2)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	traceId := hex.EncodeToString(id)
+
+	client, err := queue.NewClient(*broker, "trace_"+traceId)
+	if err != nil {
+		fmt.Println("trace: could not connect to", *broker, ":", err)
+		os.Exit(1)
+	}
+	defer client.Disconnect()
+
+	var mu sync.Mutex
+	var replies []application.TraceReply
+
+	request := application.TraceRequest{
+		TraceId:    traceId,
+		ReplyTopic: application.TRACE_RESULT_LEVEL + traceId,
+	}
+
+	_, err = client.Consume(map[string]byte{request.ReplyTopic: 1}, func(msg queue.Message) {
+		var reply application.TraceReply
+
+		if err := json.Unmarshal(msg.Payload(), &reply); err != nil || reply.TraceId != traceId {
+			return
+		}
+
+		mu.Lock()
+		replies = append(replies, reply)
+		mu.Unlock()
+	})
+
+	if err != nil {
+		fmt.Println("trace: could not subscribe to the replies:", err)
+		os.Exit(1)
+	}
+
+	requestTopic, payload := request.Serialize(*topic)
+
+	if _, err := client.Publish(requestTopic, string(payload), 1, false); err != nil {
+		fmt.Println("trace: could not send the request:", err)
+		os.Exit(1)
+	}
+
+	time.Sleep(*timeout)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	printTrace(*topic, replies)
+}
+
+// printTrace prints one line per federator reached, the closest first
+func printTrace(topic string, replies []application.TraceReply) {
+	if len(replies) == 0 {
+		fmt.Println("No federator answered the trace of", topic)
+		return
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return len(replies[i].Hops) < len(replies[j].Hops)
+	})
+
+	fmt.Println("Trace of", topic, "reached", len(replies), "federators")
+
+	for _, reply := range replies {
+		first := reply.Hops[0]
+		last := reply.Hops[len(reply.Hops)-1]
+
+		var path []string
+		for _, hop := range reply.Hops {
+			path = append(path, fmt.Sprintf("%d(%s)", hop.FederatorId, hop.Role))
+		}
+
+		elapsed := time.Duration(last.Timestamp - first.Timestamp)
+		subscribers := ""
+		if last.LocalSub {
+			subscribers = " local subscribers"
+		}
+
+		fmt.Printf("%2d hops %10s  %s%s\n", len(reply.Hops)-1, elapsed.Round(time.Microsecond), strings.Join(path, " -> "), subscribers)
+	}
+}